@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func sortBlame(entries []store.BlameEntry, order string) error {
+	switch order {
+	case "path":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	case "time":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+	case "-time":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Index > entries[j].Index })
+	default:
+		return fmt.Errorf("invalid sort order: %s", order)
+	}
+
+	return nil
+}
+
+func parseBlameTime(arg string) (time.Time, error) {
+	if arg == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.ParseInLocation(layout, arg, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %s", arg)
+}
+
+func runBlame(args []string) error {
+	flags := commandFlags("blame")
+	index := flags.Uint("version", 0, "version index to annotate (0 for head)")
+	order := flags.String("sort", "path", "sort order (path, time or -time)")
+	before := flags.String("before", "", "only list files last written before this time (e.g. 2025-01-01)")
+	after := flags.String("after", "", "only list files last written after this time (e.g. 2025-01-01)")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var filter store.BlameFilter
+	var err error
+
+	if filter.Before, err = parseBlameTime(*before); err != nil {
+		return err
+	}
+
+	if filter.After, err = parseBlameTime(*after); err != nil {
+		return err
+	}
+
+	name := "/"
+	if flags.NArg() == 2 {
+		name = path.Clean("/" + flags.Arg(1))
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Scan(); err != nil {
+		return err
+	}
+
+	entries, err := db.Blame(*index, name, filter)
+	if err != nil {
+		return err
+	}
+
+	if err := sortBlame(entries, *order); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("version: %d\ttime: %s\t%s\n", entry.Index, entry.Version.Timestamp().String(), entry.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+//
+//	command
+//
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"blame", "[options] database [path]", runBlame},
+		{"delete", "[options] database version", runDelete},
+		{"diff", "[options] database from to", runDiff},
+		{"export", "[options] database", runExport},
+		{"fsck", "[options] database", runFsck},
+		{"gc", "[options] database", runGc},
+		{"import", "[options] source database", runImport},
+		{"log", "[options] database", runLog},
+		{"migrate", "[options] database", runMigrate},
+		{"restore", "[options] database path...", runRestore},
+		{"revert", "[options] database version", runRevert},
+		{"snapshot", "[options] source database", runSnapshot},
+		{"squash", "[options] database first last", runSquash},
+		{"verify", "[options] database", runVerify},
+		{"tag", "[options] database version name", runTag},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+
+	return nil
+}
+
+func commandFlags(name string) *flag.FlagSet {
+	cmd := findCommand(name)
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n", os.Args[0], cmd.name, cmd.usage)
+		fmt.Fprintf(os.Stderr, "Parameters:\n")
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+func parseVerIndex(arg string) (uint, error) {
+	index, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil || index == 0 {
+		return 0, fmt.Errorf("invalid version index: %s", arg)
+	}
+
+	return uint(index), nil
+}
+
+func runTag(args []string) error {
+	flags := commandFlags("tag")
+	message := flags.String("message", "", "message describing the version")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	index, err := parseVerIndex(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Lock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	if err := db.Load(0); err != nil {
+		return err
+	}
+
+	vers := db.Versions()
+	if index > uint(len(vers)) {
+		return errors.New("invalid version index")
+	}
+
+	return vers[index-1].SetTag(flags.Arg(2), *message)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+//
+//	control
+//
+
+type controlRequest struct {
+	Op      string   `json:"op"`
+	Version uint     `json:"version,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+}
+
+type controlResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func controlPath(db *store.Database) string {
+	return db.AreaPath("control.sock")
+}
+
+func serveControl(db *store.Database) (func(), error) {
+	path := controlPath(db)
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go handleControl(db, conn)
+		}
+	}()
+
+	return func() {
+		listener.Close()
+		os.Remove(path)
+	}, nil
+}
+
+func handleControl(db *store.Database, conn net.Conn) {
+	defer conn.Close()
+
+	var req controlRequest
+	var resp controlResponse
+
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = err.Error()
+	} else if err := control(db, req); err != nil {
+		resp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Print(err)
+	}
+}
+
+func control(db *store.Database, req controlRequest) error {
+	switch req.Op {
+	case "restore":
+		return db.RestoreLive(req.Version, req.Paths)
+	default:
+		return fmt.Errorf("unsupported control operation: %s", req.Op)
+	}
+}
+
+func sendControl(db *store.Database, req controlRequest) (bool, error) {
+	conn, err := net.Dial("unix", controlPath(db))
+	if err != nil {
+		return false, nil
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return true, err
+	}
+
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return true, err
+	}
+
+	if resp.Error != "" {
+		return true, errors.New(resp.Error)
+	}
+
+	return true, nil
+}
@@ -25,61 +25,64 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"regexp"
-	"strconv"
-	"sync/atomic"
-	"time"
 
-	"bazil.org/fuse"
+	"github.com/FooSoft/vfs/store"
 )
 
-var inodeCnt, handleCnt uint64
+func runDelete(args []string) error {
+	flags := commandFlags("delete")
+	dryRun := flags.Bool("dry-run", false, "list changes to the following version without deleting")
+	flags.Parse(args)
 
-func allocInode() uint64 {
-	return atomic.AddUint64(&inodeCnt, 1)
-}
-
-func allocHandleId() fuse.HandleID {
-	return fuse.HandleID(atomic.AddUint64(&handleCnt, 1))
-}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
 
-func copyFile(src, dst string) (int64, error) {
-	srcFile, err := os.Open(src)
+	index, err := parseVerIndex(flags.Arg(1))
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
+	db, err := store.Open(flags.Arg(0))
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer dstFile.Close()
 
-	return io.Copy(srcFile, dstFile)
-}
+	if err := db.Lock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
 
-func buildVerName(timestamp time.Time) string {
-	return fmt.Sprintf("ver_%.16x", timestamp.Unix())
-}
+	if err := db.Load(0); err != nil {
+		return err
+	}
+
+	vers := db.Versions()
+	if index > uint(len(vers)) {
+		return errors.New("invalid version index")
+	}
+
+	ver := vers[index-1]
+	fmt.Printf("delete version: %d\ttime: %s\n", index, ver.Timestamp().String())
 
-func parseVerName(name string) (time.Time, error) {
-	re, err := regexp.Compile(`ver_([0-9a-f]+)$`)
+	moved, deleted, err := db.PlanDelete(index)
 	if err != nil {
-		return time.Unix(0, 0), err
+		return err
 	}
 
-	matches := re.FindStringSubmatch(name)
-	if len(matches) < 2 {
-		return time.Unix(0, 0), errors.New("invalid version identifier")
+	for _, path := range moved {
+		fmt.Printf("move\t%s\n", path)
 	}
 
-	timestamp, err := strconv.ParseInt(matches[1], 16, 64)
-	if err != nil {
-		return time.Unix(0, 0), err
+	for _, path := range deleted {
+		fmt.Printf("delete\t%s\n", path)
+	}
+
+	if *dryRun {
+		return nil
 	}
 
-	return time.Unix(timestamp, 0), nil
+	return db.Delete(index)
 }
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func parseVerArg(arg string) (uint, error) {
+	index, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version index: %s", arg)
+	}
+
+	return uint(index), nil
+}
+
+func runDiff(args []string) error {
+	flags := commandFlags("diff")
+	asJSON := flags.Bool("json", false, "output changes as JSON")
+	patch := flags.Bool("patch", false, "output unified diffs of changed files")
+	maxSize := flags.Int64("max-size", 1<<20, "largest file size in bytes to output unified diffs for")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	from, err := parseVerArg(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	to, err := parseVerArg(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Scan(); err != nil {
+		return err
+	}
+
+	changes, err := db.Diff(from, to)
+	if err != nil {
+		return err
+	}
+
+	if *patch {
+		for i := range changes {
+			if changes[i].Patch, err = changes[i].BuildPatch(*maxSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *asJSON {
+		if changes == nil {
+			changes = []store.Change{}
+		}
+
+		js, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(js))
+		return nil
+	}
+
+	for _, change := range changes {
+		if !*patch {
+			fmt.Println(change)
+		} else if change.Patch != "" {
+			fmt.Print(change.Patch)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func runFsck(args []string) error {
+	flags := commandFlags("fsck")
+	repair := flags.Bool("repair", false, "repair the problems found where possible")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *repair {
+		if err := db.Lock(); err != nil {
+			return err
+		}
+		defer db.Unlock()
+	}
+
+	problems, repaired, err := db.Fsck(*repair, func(name, problem string, repaired bool) {
+		if repaired {
+			fmt.Printf("%s: %s (repaired)\n", name, problem)
+		} else {
+			fmt.Printf("%s: %s\n", name, problem)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d problems found, %d repaired\n", problems+repaired, repaired)
+	if problems > 0 {
+		return errors.New("database has unrepaired problems")
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/FooSoft/vfs/store"
+	"golang.org/x/net/context"
+)
+
+func fillAttr(attr *fuse.Attr, a store.Attr) {
+	attr.Inode = a.Inode
+	attr.Size = a.Size
+	attr.Blocks = a.Blocks
+	attr.Atime, attr.Mtime, attr.Ctime = a.Atime, a.Mtime, a.Ctime
+	attr.Mode = a.Mode
+	attr.Nlink = a.Nlink
+	attr.Gid, attr.Uid = a.Gid, a.Uid
+	attr.Rdev = a.Rdev
+}
+
+func requestAttr(req *fuse.SetattrRequest) (store.Attr, int) {
+	attr := store.Attr{Mode: req.Mode, Uid: req.Uid, Gid: req.Gid, Atime: req.Atime, Mtime: req.Mtime}
+
+	var valid int
+	if req.Valid&fuse.SetattrMode != 0 {
+		valid |= store.AttrMode
+	}
+	if req.Valid&fuse.SetattrUid != 0 {
+		valid |= store.AttrUid
+	}
+	if req.Valid&fuse.SetattrGid != 0 {
+		valid |= store.AttrGid
+	}
+	if req.Valid&fuse.SetattrAtime != 0 {
+		valid |= store.AttrAtime
+	}
+	if req.Valid&fuse.SetattrMtime != 0 {
+		valid |= store.AttrMtime
+	}
+
+	return attr, valid
+}
+
+//
+//	fsRoot
+//
+
+type fsRoot struct {
+	db *store.Database
+}
+
+// FS
+func (r fsRoot) Root() (fs.Node, error) {
+	return (*fsDir)(r.db.Root()), nil
+}
+
+//
+//	fsDir
+//
+
+type fsDir store.Dir
+
+func (d *fsDir) dir() *store.Dir {
+	return (*store.Dir)(d)
+}
+
+// Node
+func (d *fsDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	a, err := d.dir().Attr()
+	if err != nil {
+		return err
+	}
+
+	fillAttr(attr, a)
+	return nil
+}
+
+// NodeGetattrer
+func (d *fsDir) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	return d.Attr(ctx, &resp.Attr)
+}
+
+// NodeSetattrer
+func (d *fsDir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	a, err := d.dir().SetAttr(requestAttr(req))
+	fillAttr(&resp.Attr, a)
+	return err
+}
+
+// NodeCreater
+func (d *fsDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	switch {
+	case req.Mode.IsDir():
+		dir, err := d.dir().CreateDir(req.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return (*fsDir)(dir), (*fsDir)(dir), nil
+	case req.Mode.IsRegular():
+		file, handle, err := d.dir().CreateFile(req.Name, int(req.Flags), req.Mode)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return (*fsFile)(file), (*fsHandle)(handle), nil
+	default:
+		return nil, nil, errors.New("unsupported filetype")
+	}
+}
+
+// NodeMkdirer
+func (d *fsDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	dir, err := d.dir().CreateDir(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*fsDir)(dir), nil
+}
+
+// NodeRemover
+func (d *fsDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if req.Dir {
+		return d.dir().RemoveDir(req.Name)
+	} else {
+		return d.dir().RemoveFile(req.Name)
+	}
+}
+
+// NodeRequestLookuper
+func (d *fsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	dir, file := d.dir().Child(name)
+	if dir != nil {
+		return (*fsDir)(dir), nil
+	}
+
+	if file != nil {
+		return (*fsFile)(file), nil
+	}
+
+	return nil, fuse.ENOENT
+}
+
+// HandleReadDirAller
+func (d *fsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var dirents []fuse.Dirent
+	for _, entry := range d.dir().Entries() {
+		dirent := fuse.Dirent{Inode: entry.Inode, Name: entry.Name, Type: fuse.DT_File}
+		if entry.Dir {
+			dirent.Type = fuse.DT_Dir
+		}
+
+		dirents = append(dirents, dirent)
+	}
+
+	return dirents, nil
+}
+
+//
+//	fsFile
+//
+
+type fsFile store.File
+
+func (f *fsFile) file() *store.File {
+	return (*store.File)(f)
+}
+
+// Node
+func (f *fsFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	a, _ := f.file().Attr()
+	fillAttr(attr, a)
+	return nil
+}
+
+// NodeGetattrer
+func (f *fsFile) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// NodeSetattrer
+func (f *fsFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	a, err := f.file().SetAttr(requestAttr(req))
+	fillAttr(&resp.Attr, a)
+	return err
+}
+
+// NodeOpener
+func (f *fsFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	handle, err := f.file().Open(int(req.Flags), 0644)
+	if err == store.ErrCorrupt {
+		return nil, fuse.EIO
+	} else if err != nil {
+		return nil, err
+	}
+
+	return (*fsHandle)(handle), nil
+}
+
+// NodeFsyncer
+func (f *fsFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return f.file().Sync()
+}
+
+//
+//	fsHandle
+//
+
+type fsHandle store.Handle
+
+func (h *fsHandle) handle() *store.Handle {
+	return (*store.Handle)(h)
+}
+
+// HandleReader
+func (h *fsHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	resp.Data = make([]byte, req.Size)
+	if _, err := h.handle().ReadAt(resp.Data, req.Offset); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// HandleReadAller
+func (h *fsHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return h.handle().ReadAll()
+}
+
+// HandleWriter
+func (h *fsHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	size, err := h.handle().WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = size
+	return nil
+}
+
+// HandleReleaser
+func (h *fsHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.handle().Close()
+}
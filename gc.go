@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func runGc(args []string) error {
+	var policy store.GcPolicy
+
+	flags := commandFlags("gc")
+	flags.IntVar(&policy.Last, "keep-last", 0, "keep the most recent versions")
+	flags.IntVar(&policy.Hourly, "keep-hourly", 0, "keep the most recent version for this many hours")
+	flags.IntVar(&policy.Daily, "keep-daily", 0, "keep the most recent version for this many days")
+	flags.IntVar(&policy.Weekly, "keep-weekly", 0, "keep the most recent version for this many weeks")
+	flags.IntVar(&policy.Monthly, "keep-monthly", 0, "keep the most recent version for this many months")
+	flags.BoolVar(&policy.Tagged, "keep-tagged", false, "keep all tagged versions")
+	dryRun := flags.Bool("dry-run", false, "list versions to remove without removing them")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if !policy.Enabled() {
+		return errors.New("no retention policy specified")
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Lock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	if err := db.Load(0); err != nil {
+		return err
+	}
+
+	keep := policy.Keep(db.Versions())
+	for index, ver := range db.Versions() {
+		if !keep[index] {
+			fmt.Printf("remove version: %d\ttime: %s\n", index+1, ver.Timestamp().String())
+		}
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	return db.Prune(keep)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func printLog(entry *store.LogEntry, paths bool) {
+	if entry.Tag == "" {
+		fmt.Printf("version: %d\ttime: %s\n", entry.Index, entry.Timestamp.String())
+	} else {
+		fmt.Printf("version: %d\ttime: %s\ttag: %s\n", entry.Index, entry.Timestamp.String(), entry.Tag)
+	}
+
+	if entry.Message != "" {
+		fmt.Printf("\t%s\n", entry.Message)
+	}
+
+	fmt.Printf("\t%d created, %d modified, %d deleted, %d bytes added\n", entry.Created, entry.Modified, entry.Deleted, entry.Bytes)
+
+	if paths {
+		for _, change := range entry.Changes {
+			fmt.Printf("\t%s\n", change)
+		}
+	}
+}
+
+func runLog(args []string) error {
+	flags := commandFlags("log")
+	paths := flags.Bool("paths", false, "list the paths changed by each version")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Scan(); err != nil {
+		return err
+	}
+
+	return db.Log(func(entry *store.LogEntry) error {
+		printLog(entry, *paths)
+		return nil
+	})
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func cleanPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		name := path.Clean("/" + arg)
+		if name == "/" {
+			return nil, errors.New("cannot restore root directory, use revert instead")
+		}
+
+		paths = append(paths, name)
+	}
+
+	return paths, nil
+}
+
+func runRestore(args []string) error {
+	flags := commandFlags("restore")
+	index := flags.Uint("version", 0, "version index to restore from")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 || *index == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := cleanPaths(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if served, err := sendControl(db, controlRequest{Op: "restore", Version: *index, Paths: paths}); served {
+		return err
+	}
+
+	if err := db.Lock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	if err := db.Load(0); err != nil {
+		return err
+	}
+
+	ver, err := db.Restore(*index, paths)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("version: %d\ttime: %s\n", len(db.Versions()), ver.Timestamp().String())
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/FooSoft/vfs/store"
+)
+
+// handleSignals unmounts the database when the process is told to terminate;
+// the returned function stops handling signals and reports the one received.
+func handleSignals(db *store.Database, mountpoint string, mutable bool, timeout time.Duration) func() os.Signal {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	var received os.Signal
+	go func() {
+		defer close(done)
+
+		select {
+		case sig := <-signals:
+			log.Printf("received %s, unmounting", sig)
+			received = sig
+			shutdown(db, mountpoint, mutable, sig, signals, timeout)
+		case <-quit:
+		}
+	}()
+
+	return func() os.Signal {
+		signal.Stop(signals)
+		close(quit)
+		<-done
+		return received
+	}
+}
+
+func shutdown(db *store.Database, mountpoint string, mutable bool, sig os.Signal, signals chan os.Signal, timeout time.Duration) {
+	db.SyncHandles()
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for waiting := false; ; waiting = true {
+		err := fuse.Unmount(mountpoint)
+		if err == nil {
+			return
+		}
+
+		if !waiting {
+			log.Printf("waiting up to %s for open files to be closed: %s", timeout, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Print("timed out waiting for open files, forcing unmount")
+			forceShutdown(db, mountpoint, mutable, sig)
+		case again := <-signals:
+			log.Printf("received %s again, forcing unmount", again)
+			forceShutdown(db, mountpoint, mutable, sig)
+		}
+	}
+}
+
+// forceShutdown never returns; the database is saved with further changes
+// held off, since file system requests may still be in flight.
+func forceShutdown(db *store.Database, mountpoint string, mutable bool, sig os.Signal) {
+	db.SyncHandles()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "linux" {
+		cmd = exec.Command("fusermount", "-u", "-z", mountpoint)
+	} else {
+		cmd = exec.Command("umount", "-f", mountpoint)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("%s: %s", err, out)
+	}
+
+	status := signalStatus(sig)
+	if mutable {
+		if err := db.Halt(); err != nil {
+			log.Print(err)
+			status = 1
+		}
+	}
+
+	if err := db.Unlock(); err != nil {
+		log.Print(err)
+	}
+
+	os.Exit(status)
+}
+
+// signalStatus returns the exit status of a process terminated by a signal,
+// as reported by the shell.
+func signalStatus(sig os.Signal) int {
+	if signo, ok := sig.(syscall.Signal); ok {
+		return 128 + int(signo)
+	}
+
+	return 1
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func runSnapshot(args []string) error {
+	flags := commandFlags("snapshot")
+	hash := flags.Bool("hash", false, "compare file contents instead of sizes and modification times")
+	tag := flags.String("tag", "", "tag for the new version")
+	message := flags.String("message", "", "message for the new version")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	info, err := os.Stat(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", flags.Arg(0))
+	}
+
+	db, err := store.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Lock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	if err := db.Scan(); err != nil {
+		return err
+	}
+
+	opts := store.ImportOptions{Hash: *hash, Live: true, Tag: *tag, Message: *message}
+
+	ver, err := db.Import(flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+
+	if ver == nil {
+		fmt.Println("no changes since the last version")
+		return nil
+	}
+
+	fmt.Printf("version: %d\ttime: %s\n", len(db.Versions()), ver.Timestamp().String())
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/FooSoft/vfs/store"
+)
+
+func runSquash(args []string) error {
+	flags := commandFlags("squash")
+	dryRun := flags.Bool("dry-run", false, "list versions to merge without merging them")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	first, err := parseVerIndex(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	last, err := parseVerIndex(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	db, err := store.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := db.Lock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	if err := db.Load(0); err != nil {
+		return err
+	}
+
+	vers := db.Versions()
+	if first >= last || last > uint(len(vers)) {
+		return errors.New("invalid version range")
+	}
+
+	keep := make([]bool, len(vers))
+	for index, ver := range vers {
+		keep[index] = uint(index+1) < first || uint(index+1) >= last
+		if !keep[index] {
+			fmt.Printf("merge version: %d\ttime: %s\n", index+1, ver.Timestamp().String())
+		}
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	return db.Prune(keep)
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//
+//	Backend
+//
+
+// Backend stores the versions of a database. Names are slash separated paths
+// relative to the database, such as ver_<timestamp>/root/dir/file; Stat and
+// Lstat report a *syscall.Stat_t from Sys so ownership and times survive.
+// Chown changes symbolic links rather than their targets, and Rename moves
+// whole directories and replaces existing files.
+type Backend interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	List(name string) ([]os.FileInfo, error)
+	Open(name string) (BackendFile, error)
+	OpenFile(name string, flags int, mode os.FileMode) (BackendFile, error)
+	Mkdir(name string, mode os.FileMode) error
+	Symlink(target, name string) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+	ReadMeta(name string) ([]byte, error)
+	WriteMeta(name string, data []byte) error
+}
+
+type BackendFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Sync() error
+}
+
+// flusher is implemented by backends that hold modified files locally until
+// they are released; versions are flushed when they are finalized.
+type flusher interface {
+	Flush(name string) error
+}
+
+// linker is implemented by backends that can share the contents of a file
+// between versions instead of copying them.
+type linker interface {
+	Link(oldname, newname string) error
+}
+
+// sharedBackend is implemented by backends that other hosts can reach, which
+// the lock in the database directory does not keep out; they are only written
+// to once the user vouches that a single host does so.
+type sharedBackend interface {
+	Exclusive() bool
+}
+
+// xattrStore is implemented by backends that keep extended attributes.
+type xattrStore interface {
+	ReadXattrs(name string) (map[string]string, error)
+	WriteXattrs(name string, xattrs map[string]string) error
+}
+
+func mkdirAll(b Backend, name string, mode os.FileMode) error {
+	if info, err := b.Stat(name); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	if parent := path.Dir(name); parent != name && parent != "." && parent != "/" {
+		if err := mkdirAll(b, parent, mode); err != nil {
+			return err
+		}
+	}
+
+	if err := b.Mkdir(name, mode); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func readFile(b Backend, name string) ([]byte, error) {
+	file, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// walkTree calls fn with the name relative to root of every entry below it,
+// directories before their contents.
+func walkTree(b Backend, root string, fn func(rel string, info os.FileInfo) error) error {
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		infos, err := b.List(path.Join(root, rel))
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			child := path.Join(rel, info.Name())
+			if err := fn(child, info); err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return walk("/")
+}
+
+// walkFiles calls fn with the name relative to root of every regular file
+// below it.
+func walkFiles(b Backend, root string, fn func(rel string, info os.FileInfo) error) error {
+	return walkTree(b, root, func(rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return fn(rel, info)
+	})
+}
+
+//
+//	dirBackend
+//
+
+// hostFS resolves absolute names on the host; it serves the sources of imports
+// and the local caches of other backends.
+var hostFS = newDirBackend("/")
+
+type dirBackend struct {
+	root string
+}
+
+func newDirBackend(root string) *dirBackend {
+	return &dirBackend{root}
+}
+
+func (b *dirBackend) path(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+func (b *dirBackend) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(b.path(name))
+}
+
+func (b *dirBackend) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(b.path(name))
+}
+
+func (b *dirBackend) Readlink(name string) (string, error) {
+	return os.Readlink(b.path(name))
+}
+
+func (b *dirBackend) List(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(b.path(name))
+}
+
+func (b *dirBackend) Open(name string) (BackendFile, error) {
+	return b.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (b *dirBackend) OpenFile(name string, flags int, mode os.FileMode) (BackendFile, error) {
+	file, err := os.OpenFile(b.path(name), flags, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (b *dirBackend) Mkdir(name string, mode os.FileMode) error {
+	return os.Mkdir(b.path(name), mode)
+}
+
+func (b *dirBackend) Symlink(target, name string) error {
+	return os.Symlink(target, b.path(name))
+}
+
+func (b *dirBackend) Rename(oldname, newname string) error {
+	return os.Rename(b.path(oldname), b.path(newname))
+}
+
+func (b *dirBackend) Link(oldname, newname string) error {
+	return os.Link(b.path(oldname), b.path(newname))
+}
+
+func (b *dirBackend) Remove(name string) error {
+	return os.Remove(b.path(name))
+}
+
+func (b *dirBackend) RemoveAll(name string) error {
+	return os.RemoveAll(b.path(name))
+}
+
+func (b *dirBackend) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(b.path(name), mode)
+}
+
+func (b *dirBackend) Chown(name string, uid, gid int) error {
+	return os.Lchown(b.path(name), uid, gid)
+}
+
+func (b *dirBackend) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(b.path(name), atime, mtime)
+}
+
+func (b *dirBackend) ReadMeta(name string) ([]byte, error) {
+	return ioutil.ReadFile(b.path(name))
+}
+
+func (b *dirBackend) WriteMeta(name string, data []byte) error {
+	return writeFileAtomic(b.path(name), data, 0644)
+}
+
+func (b *dirBackend) ReadXattrs(name string) (map[string]string, error) {
+	return readXattrs(b.path(name))
+}
+
+func (b *dirBackend) WriteXattrs(name string, xattrs map[string]string) error {
+	return writeXattrs(b.path(name), xattrs)
+}
+
+//
+//	attrInfo
+//
+
+// attrInfo describes entries of backends that do not keep them on the host.
+type attrInfo struct {
+	name string
+	attr fileAttr
+	stat *syscall.Stat_t
+}
+
+func newAttrInfo(name string, attr fileAttr, size int64, ctime time.Time) *attrInfo {
+	stat := &syscall.Stat_t{
+		Size:   size,
+		Blocks: (size + 511) / 512,
+		Nlink:  1,
+		Uid:    uint32(attr.uid),
+		Gid:    uint32(attr.gid),
+		Atim:   syscall.NsecToTimespec(attr.atime.UnixNano()),
+		Mtim:   syscall.NsecToTimespec(attr.mtime.UnixNano()),
+		Ctim:   syscall.NsecToTimespec(ctime.UnixNano()),
+	}
+
+	return &attrInfo{name, attr, stat}
+}
+
+func (i *attrInfo) Name() string {
+	return i.name
+}
+
+func (i *attrInfo) Size() int64 {
+	return i.stat.Size
+}
+
+func (i *attrInfo) Mode() os.FileMode {
+	return i.attr.mode
+}
+
+func (i *attrInfo) ModTime() time.Time {
+	return i.attr.mtime
+}
+
+func (i *attrInfo) IsDir() bool {
+	return i.attr.mode.IsDir()
+}
+
+func (i *attrInfo) Sys() interface{} {
+	return i.stat
+}
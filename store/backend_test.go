@@ -0,0 +1,280 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rawBackends = []struct {
+	name string
+	open func(t *testing.T) Backend
+}{
+	{"dir", func(t *testing.T) Backend { return newDirBackend(tempDir(t)) }},
+	{"memory", func(t *testing.T) Backend { return NewMemoryBackend() }},
+	{"s3", func(t *testing.T) Backend {
+		b, err := NewS3Backend(newS3Config(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	}},
+}
+
+func putFile(t *testing.T, b Backend, name, data string) {
+	file, err := b.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getFile(t *testing.T, b Backend, name string) string {
+	data, err := readFile(b, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func listNames(t *testing.T, b Backend, name string) string {
+	infos, err := b.List(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestBackend(t *testing.T) {
+	for _, rb := range rawBackends {
+		rb := rb
+		t.Run(rb.name, func(t *testing.T) {
+			testBackendOps(t, rb.open(t))
+		})
+	}
+}
+
+func testBackendOps(t *testing.T, b Backend) {
+	if err := mkdirAll(b, "ver/root/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	putFile(t, b, "ver/root/a/f", "hello")
+	putFile(t, b, "ver/root/a/g", "world")
+
+	if got := getFile(t, b, "ver/root/a/f"); got != "hello" {
+		t.Errorf("read %q", got)
+	}
+
+	if got := listNames(t, b, "ver/root/a"); got != "f,g" {
+		t.Errorf("listed %q", got)
+	}
+
+	info, err := b.Stat("ver/root/a/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != 5 || info.Mode() != 0640 || info.IsDir() {
+		t.Errorf("stat reported size %d and mode %s", info.Size(), info.Mode())
+	}
+
+	if err := b.Symlink("f", "ver/root/a/l"); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := b.Readlink("ver/root/a/l"); err != nil || target != "f" {
+		t.Errorf("readlink returned %q, %v", target, err)
+	}
+
+	if info, err := b.Lstat("ver/root/a/l"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat did not report a link: %v", err)
+	}
+
+	if err := b.Chmod("ver/root/a/f", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	if err := b.Chtimes("ver/root/a/f", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Chown("ver/root/a/f", os.Geteuid(), os.Getegid()); err != nil {
+		t.Fatal(err)
+	}
+
+	attr, err := backendAttr(b, "ver/root/a/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attr.mode != 0600 || !attr.mtime.Equal(mtime) || attr.uid != os.Geteuid() {
+		t.Errorf("attributes not changed: %+v", attr)
+	}
+
+	if err := b.Rename("ver/root/a/g", "ver/root/a/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getFile(t, b, "ver/root/a/f"); got != "world" {
+		t.Errorf("rename did not replace the file: %q", got)
+	}
+
+	if err := b.WriteMeta("ver/meta.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Rename("ver", "moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Stat("ver"); !os.IsNotExist(err) {
+		t.Errorf("renamed directory still exists: %v", err)
+	}
+
+	if got := getFile(t, b, "moved/root/a/f"); got != "world" {
+		t.Errorf("renamed directory lost contents: %q", got)
+	}
+
+	if data, err := b.ReadMeta("moved/meta.json"); err != nil || string(data) != "{}" {
+		t.Errorf("renamed directory lost metadata: %q, %v", data, err)
+	}
+
+	if err := b.Remove("moved/root/a"); err == nil {
+		t.Error("removed a directory that is not empty")
+	}
+
+	if err := b.RemoveAll("moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listNames(t, b, ""); got != "" {
+		t.Errorf("entries left after removal: %q", got)
+	}
+}
+
+func TestBackendMaintenance(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a/f", "one")
+		writeFile(t, db, "/a/g", "two")
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFile(t, db, "/a/f", "three")
+		removeAll(t, db, "/a/g")
+		writeFile(t, db, "/b", "four")
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		removeAll(t, db, "/a")
+		writeFile(t, db, "/a", "five")
+		unmount(t, db)
+
+		src := tempDir(t)
+		if err := ioutil.WriteFile(src+"/c", []byte("six"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink("c", src+"/d"); err != nil {
+			t.Fatal(err)
+		}
+
+		db = reopen(t, db)
+		if err := db.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unlock()
+
+		if err := db.Load(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Import(src, ImportOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Load(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Revert(2, "", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Load(0); err != nil {
+			t.Fatal(err)
+		}
+
+		trees := readVersions(t, db)
+		if len(trees) != 5 {
+			t.Fatalf("expected 5 versions, found %d", len(trees))
+		}
+
+		compareTrees(t, "import", map[string]string{"/": "dir", "/c": "file:six", "/d": "link:c"}, trees[3])
+		compareTrees(t, "revert", trees[1], trees[4])
+
+		if err := db.Prune([]bool{true, false, false, true, true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Delete(1); err != nil {
+			t.Fatal(err)
+		}
+
+		after := readVersions(t, db)
+		if len(after) != 2 {
+			t.Fatalf("expected 2 versions, found %d", len(after))
+		}
+
+		compareTrees(t, "squash", trees[3], after[0])
+		compareTrees(t, "squash", trees[4], after[1])
+
+		problems, _, err := db.Fsck(false, func(name, problem string, repaired bool) { t.Errorf("fsck: %s: %s", name, problem) })
+		if err != nil || problems != 0 {
+			t.Fatalf("fsck found %d problems: %v", problems, err)
+		}
+	})
+}
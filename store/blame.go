@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//
+//	BlameEntry
+//
+
+type BlameEntry struct {
+	Path    string
+	Index   int
+	Version *Version
+}
+
+type BlameFilter struct {
+	Before time.Time
+	After  time.Time
+}
+
+func (f BlameFilter) match(ver *Version) bool {
+	if !f.Before.IsZero() && !ver.timestamp.Before(f.Before) {
+		return false
+	}
+
+	if !f.After.IsZero() && !ver.timestamp.After(f.After) {
+		return false
+	}
+
+	return true
+}
+
+func (db *Database) Blame(index uint, name string, filter BlameFilter) ([]BlameEntry, error) {
+	if index > uint(len(db.vers)) || len(db.vers) == 0 {
+		return nil, errors.New("invalid version index")
+	}
+
+	if index == 0 {
+		index = uint(len(db.vers))
+	}
+
+	indices := make(map[*Version]int)
+	for i, ver := range db.vers {
+		indices[ver] = i + 1
+	}
+
+	ver := db.vers[index-1]
+	if err := ver.resolve(); err != nil {
+		return nil, err
+	}
+
+	var entries []BlameEntry
+	add := func(node *Node) error {
+		if node.flags&NodeFlagDir == 0 && filter.match(node.ver) {
+			entries = append(entries, BlameEntry{node.path, indices[node.ver], node.ver})
+		}
+
+		return nil
+	}
+
+	if dir := ver.root.Lookup(name); dir != nil {
+		dir.Walk(add)
+	} else if node := ver.root.LookupNode(name); node != nil {
+		add(node)
+	} else {
+		return nil, fmt.Errorf("path not found: %s", name)
+	}
+
+	return entries, nil
+}
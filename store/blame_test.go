@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "a")
+		writeFile(t, db, "/d/x", "x")
+		writeFile(t, db, "/d/y", "one")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/d/y", "two")
+		writeFile(t, db, "/b", "b")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/c", "c")
+		unmount(t, db)
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		vers := db.Versions()
+		blame := func(index uint, name string, filter BlameFilter) []string {
+			entries, err := db.Blame(index, name, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lines []string
+			for _, entry := range entries {
+				if entry.Version != vers[entry.Index-1] {
+					t.Errorf("%s: index %d does not match its version", entry.Path, entry.Index)
+				}
+
+				lines = append(lines, fmt.Sprintf("%s@%d", entry.Path, entry.Index))
+			}
+
+			return lines
+		}
+
+		tests := []struct {
+			index    uint
+			name     string
+			filter   BlameFilter
+			expected []string
+		}{
+			{0, "/", BlameFilter{}, []string{"/a@1", "/b@2", "/c@3", "/d/x@1", "/d/y@2"}},
+			{1, "/", BlameFilter{}, []string{"/a@1", "/d/x@1", "/d/y@1"}},
+			{0, "/d", BlameFilter{}, []string{"/d/x@1", "/d/y@2"}},
+			{0, "/d/y", BlameFilter{}, []string{"/d/y@2"}},
+			{0, "/", BlameFilter{After: vers[0].Timestamp()}, []string{"/b@2", "/c@3", "/d/y@2"}},
+			{0, "/", BlameFilter{Before: vers[2].Timestamp()}, []string{"/a@1", "/b@2", "/d/x@1", "/d/y@2"}},
+			{0, "/", BlameFilter{After: vers[0].Timestamp(), Before: vers[2].Timestamp()}, []string{"/b@2", "/d/y@2"}},
+		}
+
+		for _, test := range tests {
+			if lines := blame(test.index, test.name, test.filter); !reflect.DeepEqual(lines, test.expected) {
+				t.Errorf("blame %d %s: expected %q, got %q", test.index, test.name, test.expected, lines)
+			}
+		}
+
+		if _, err := db.Blame(0, "/missing", BlameFilter{}); err == nil {
+			t.Error("blamed a missing path")
+		}
+
+		if _, err := db.Blame(4, "/", BlameFilter{}); err == nil {
+			t.Error("blamed a version past the head")
+		}
+	})
+}
@@ -0,0 +1,529 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package store implements the versioned database behind vfs: scanning and
+// loading versions, mutating the head tree and the maintenance operations
+// exposed by the command line tool.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+//	Database
+//
+
+type Database struct {
+	base       string
+	backend    Backend
+	vers       verList
+	root       *Dir
+	invalidate func(dir *Dir, name string)
+	written    uint64
+	touched    time.Time
+	verify     int64
+	handles    map[*Handle]bool
+	lockFile   *os.File
+	writers    int
+	changes    sync.RWMutex
+	mutex      sync.Mutex
+}
+
+// Open returns the database stored in the given directory, or in the bucket
+// described by its .vfs/s3.json file; versions are not read until Scan or Load
+// is called.
+func Open(path string) (*Database, error) {
+	base, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := loadS3Backend(base)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenBackend(base, backend)
+}
+
+// OpenBackend returns a database whose versions are kept by the given backend,
+// with locks, journals and other runtime state in the given directory. A nil
+// backend keeps versions in the directory itself.
+func OpenBackend(path string, backend Backend) (*Database, error) {
+	base, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend == nil {
+		backend = newDirBackend(base)
+	}
+
+	return &Database{base: base, backend: backend, handles: make(map[*Handle]bool)}, nil
+}
+
+const dbFormat = 1
+
+func (db *Database) AreaPath(names ...string) string {
+	return filepath.Join(append([]string{db.base, ".vfs"}, names...)...)
+}
+
+func (db *Database) readFormat() (int, error) {
+	data, err := ioutil.ReadFile(db.AreaPath("format"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	format, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid database format marker: %s", db.AreaPath("format"))
+	}
+
+	return format, nil
+}
+
+func (db *Database) setFormat(format int) error {
+	if err := os.MkdirAll(db.AreaPath(), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(db.AreaPath("format"), []byte(fmt.Sprintf("%d\n", format)), 0644)
+}
+
+// New databases are stamped with the current format; databases that already
+// hold versions in an older format have to be upgraded with migrate first.
+func (db *Database) writeFormat() error {
+	format, err := db.readFormat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case format > dbFormat:
+		return fmt.Errorf("database format %d is newer than the supported format %d", format, dbFormat)
+	case format == dbFormat:
+		return nil
+	}
+
+	if format == 0 {
+		empty, err := db.empty()
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			return db.setFormat(dbFormat)
+		}
+	}
+
+	return fmt.Errorf("database format %d is out of date, upgrade it with the migrate command", format)
+}
+
+func (db *Database) empty() (bool, error) {
+	infos, err := db.backend.List("")
+	if err != nil {
+		return false, err
+	}
+
+	for _, info := range infos {
+		if _, err := parseVerName(info.Name()); err == nil && info.IsDir() {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (db *Database) checkFormat() error {
+	format, err := db.readFormat()
+	if err != nil {
+		return err
+	}
+
+	if format > dbFormat {
+		return fmt.Errorf("database format %d is newer than the supported format %d", format, dbFormat)
+	}
+
+	return nil
+}
+
+// Scan reads the list of versions without resolving their trees.
+func (db *Database) Scan() error {
+	if err := db.checkFormat(); err != nil {
+		return err
+	}
+
+	var err error
+	db.vers, err = db.loadVers()
+	return err
+}
+
+// Load scans the database and resolves the tree of the version at the given
+// one-based index, or of the head version when index is zero.
+func (db *Database) Load(index uint) error {
+	if err := db.Scan(); err != nil {
+		return err
+	}
+
+	// only the lock holder may finalize versions left behind by a crash;
+	// other readers resolve them with their journals replayed in memory
+	if db.lockFile != nil {
+		if err := db.recover(); err != nil {
+			return err
+		}
+	}
+
+	if index > uint(len(db.vers)) {
+		return errors.New("invalid version index")
+	}
+
+	if index > 0 {
+		db.vers = db.vers[:index]
+	}
+
+	if lastVer := db.lastVer(); lastVer != nil {
+		if err := lastVer.resolve(); err != nil {
+			return err
+		}
+
+		db.root = lastVer.root
+	}
+
+	return nil
+}
+
+func (db *Database) recover() error {
+	lastVer := db.lastVer()
+
+	var vers verList
+	var pv *Version
+	for _, ver := range db.vers {
+		ver.parent = pv
+
+		// versions left empty by a crash are dropped as a clean shutdown would
+		// have done; the head may have just been created by this writer
+		if ver != lastVer {
+			abandoned, err := ver.abandoned()
+			if err != nil {
+				return err
+			}
+
+			if abandoned {
+				if err := ver.discard(); err != nil {
+					return err
+				}
+
+				continue
+			}
+		}
+
+		if ver.meta.modified {
+			if err := ver.finalize(ver == lastVer); err != nil {
+				return err
+			}
+		}
+
+		vers = append(vers, ver)
+		pv = ver
+	}
+
+	db.mutex.Lock()
+	db.vers = vers
+	db.mutex.Unlock()
+
+	return nil
+}
+
+// Save writes out the metadata of all modified versions.
+func (db *Database) Save() error {
+	return db.save(db.lastVer())
+}
+
+// Halt saves the database for a forced shutdown and keeps the handle locked
+// afterwards, so that no version is cut and no file is copied into the head
+// once it has been written out.
+func (db *Database) Halt() error {
+	db.mutex.Lock()
+
+	var lastVer *Version
+	if count := len(db.vers); count > 0 {
+		lastVer = db.vers[count-1]
+	}
+
+	return db.save(lastVer)
+}
+
+func (db *Database) save(lastVer *Version) error {
+	for _, ver := range db.vers {
+		if err := ver.finalize(ver == lastVer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *Database) loadVers() (verList, error) {
+	nodes, err := db.backend.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var vers verList
+	for _, node := range nodes {
+		if !node.IsDir() || strings.HasPrefix(node.Name(), ".") {
+			continue
+		}
+
+		// foreign directories are reported by fsck
+		timestamp, err := parseVerName(node.Name())
+		if err != nil {
+			continue
+		}
+
+		ver, err := newVer(node.Name(), timestamp, db)
+		if err != nil {
+			return nil, err
+		}
+
+		vers = append(vers, ver)
+	}
+
+	sort.Sort(vers)
+
+	var pv *Version
+	for _, ver := range vers {
+		ver.parent = pv
+		pv = ver
+	}
+
+	return vers, nil
+}
+
+func (db *Database) lastVer() *Version {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	count := len(db.vers)
+	if count == 0 {
+		return nil
+	}
+
+	return db.vers[count-1]
+}
+
+// CreateVersion creates an empty version after the existing ones; it becomes
+// the head when the database is next loaded.
+func (db *Database) CreateVersion() error {
+	_, err := db.createVerDir(time.Now())
+	return err
+}
+
+func (db *Database) createVerDir(timestamp time.Time) (string, error) {
+	name := buildVerName(timestamp)
+	if err := db.backend.Mkdir(name, 0755); os.IsExist(err) {
+		return "", fmt.Errorf("version already exists: %s", name)
+	} else if err != nil {
+		return "", err
+	}
+
+	if err := db.backend.Mkdir(path.Join(name, "root"), 0755); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Checkpoint finalizes the head version and starts a new one on top of it;
+// it fails while files are open for writing, as they would keep writing into
+// the finalized version.
+func (db *Database) Checkpoint() error {
+	return db.checkpoint(time.Now(), func() (bool, error) {
+		if db.writers > 0 {
+			return false, errors.New("files are open for writing")
+		}
+
+		return true, nil
+	})
+}
+
+// checkpoint cuts the head when due says so, then finalizes the former head
+// once file system operations already go to the new one.
+func (db *Database) checkpoint(timestamp time.Time, due func() (bool, error)) error {
+	db.changes.Lock()
+	db.mutex.Lock()
+
+	var head *Version
+	ok, err := due()
+	if ok && err == nil {
+		head, err = db.cutVer(timestamp)
+	}
+
+	db.mutex.Unlock()
+	db.changes.Unlock()
+
+	if head == nil || err != nil {
+		return err
+	}
+
+	return head.finalize(false)
+}
+
+func (db *Database) checkTimestamp(timestamp time.Time) error {
+	if count := len(db.vers); count > 0 && !timestamp.After(db.vers[count-1].timestamp) {
+		return errors.New("version timestamp collision")
+	}
+
+	return nil
+}
+
+// cutVer starts a new head version and returns the former one, which is left
+// for the caller to finalize.
+func (db *Database) cutVer(timestamp time.Time) (*Version, error) {
+	if err := db.checkTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	head := db.vers[len(db.vers)-1]
+
+	dir, err := db.createVerDir(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ver, err := newVer(dir, timestamp, db)
+	if err != nil {
+		return nil, err
+	}
+
+	ver.parent = head
+	db.vers = append(db.vers, ver)
+	db.written = 0
+
+	return head, nil
+}
+
+// addVer appends a version created on top of the head, so that the handle
+// stays usable for further operations.
+func (db *Database) addVer(ver *Version) {
+	db.mutex.Lock()
+	db.vers = append(db.vers, ver)
+	db.mutex.Unlock()
+}
+
+// beginChange is called by operations that copy entries into the head or
+// change its metadata, so that the head is not cut while they are under way.
+func (db *Database) beginChange() {
+	db.changes.RLock()
+}
+
+func (db *Database) endChange() {
+	db.changes.RUnlock()
+}
+
+func (db *Database) beginWrite() {
+	db.mutex.Lock()
+	db.writers++
+	db.mutex.Unlock()
+}
+
+func (db *Database) endWrite() {
+	db.mutex.Lock()
+	db.writers--
+	db.mutex.Unlock()
+}
+
+func (db *Database) touch(size int) {
+	db.mutex.Lock()
+	db.written += uint64(size)
+	db.touched = time.Now()
+	db.mutex.Unlock()
+}
+
+func (db *Database) Path() string {
+	return db.base
+}
+
+func (db *Database) Versions() []*Version {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return append([]*Version(nil), db.vers...)
+}
+
+func (db *Database) Head() *Version {
+	return db.lastVer()
+}
+
+// Root returns the tree of the version loaded by Load.
+func (db *Database) Root() *Dir {
+	return db.root
+}
+
+// SetVerify makes files smaller than limit bytes be verified against their
+// checksums when opened; zero disables verification.
+func (db *Database) SetVerify(limit int64) {
+	db.verify = limit
+}
+
+// SetInvalidate registers a function called when an entry of a loaded tree is
+// replaced behind the back of its users, as happens with live restores.
+func (db *Database) SetInvalidate(fn func(dir *Dir, name string)) {
+	db.invalidate = fn
+}
+
+func (db *Database) SyncHandles() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for handle := range db.handles {
+		if err := handle.sync(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (db *Database) addHandle(handle *Handle) {
+	db.mutex.Lock()
+	db.handles[handle] = true
+	db.mutex.Unlock()
+}
+
+func (db *Database) removeHandle(handle *Handle) {
+	db.mutex.Lock()
+	delete(db.handles, handle)
+	db.mutex.Unlock()
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import "testing"
+
+// Versions created through a handle are visible to the operations that
+// follow on the same handle.
+func TestHandleStaysCurrent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/f", "one")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/f", "two")
+		unmount(t, db)
+
+		src := tempDir(t)
+		hostFiles(t, src, 1, map[string]string{"g": "three"})
+
+		db = reopen(t, db)
+		if err := db.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unlock()
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the command line reports the index of a new version as the length
+		// of the list
+		checkHead := func(ver *Version, err error) {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if vers := db.Versions(); vers[len(vers)-1] != ver {
+				t.Fatalf("version %s is not the last of %d", ver.Name(), len(vers))
+			}
+		}
+
+		checkHead(db.Revert(1, "", ""))
+		checkHead(db.Restore(2, []string{"/f"}))
+		checkHead(db.Import(src, ImportOptions{}))
+
+		if n := len(db.Versions()); n != 5 {
+			t.Fatalf("handle lists %d versions", n)
+		}
+
+		if err := db.Delete(5); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Prune([]bool{true, false, true, true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := len(db.Versions()); n != 3 {
+			t.Fatalf("handle lists %d versions", n)
+		}
+
+		trees := readVersions(t, db)
+		if len(trees) != 3 {
+			t.Fatalf("found %d versions", len(trees))
+		}
+
+		for i, data := range []string{"one", "one", "two"} {
+			compareTrees(t, db.Versions()[i].Name(), map[string]string{"/": "dir", "/f": "file:" + data}, trees[i])
+		}
+	})
+}
+
+func TestHalt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/f", "one")
+		removeAll(t, db, "/f")
+		writeFile(t, db, "/g", "two")
+
+		if err := db.Halt(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		trees := readVersions(t, db)
+		if len(trees) != 1 {
+			t.Fatalf("expected 1 version, got %d", len(trees))
+		}
+
+		compareTrees(t, "halted", map[string]string{"/": "dir", "/g": "file:two"}, trees[0])
+	})
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+)
+
+//
+//	Database
+//
+
+// PlanDelete lists the paths stored by a version that would move into the
+// version following it, and the deletions that would be recorded there, if
+// the version were deleted.
+func (db *Database) PlanDelete(index uint) (moved, deleted []string, err error) {
+	if index == 0 || index > uint(len(db.vers)) {
+		return nil, nil, errors.New("invalid version index")
+	}
+
+	ver := db.vers[index-1]
+	if ver == db.lastVer() {
+		return nil, nil, nil
+	}
+
+	plan, err := db.planSquash(int(index-1), int(index))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, node := range plan.nodes {
+		if node.ver == ver {
+			moved = append(moved, node.path)
+		}
+	}
+
+	for _, path := range plan.deleted {
+		if isDeleted, _ := plan.target.meta.deleted[path]; !isDeleted {
+			deleted = append(deleted, path)
+		}
+	}
+
+	return moved, deleted, nil
+}
+
+func (db *Database) Delete(index uint) error {
+	if index == 0 || index > uint(len(db.vers)) {
+		return errors.New("invalid version index")
+	}
+
+	if ver := db.vers[index-1]; ver == db.lastVer() {
+		if err := db.backend.RemoveAll(ver.dir); err != nil {
+			return err
+		}
+
+		return db.Load(0)
+	}
+
+	keep := make([]bool, len(db.vers))
+	for i := range keep {
+		keep[i] = uint(i+1) != index
+	}
+
+	return db.Prune(keep)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+		writeFile(t, db, "/d/x", "x")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/a", "two")
+		writeFile(t, db, "/b", "b")
+		removeAll(t, db, "/d/x")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/c", "c")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/e", "e")
+		unmount(t, db)
+
+		before := readVersions(t, db)
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Delete(0); err == nil {
+			t.Error("deleted version 0")
+		}
+
+		if err := db.Delete(5); err == nil {
+			t.Error("deleted a version past the head")
+		}
+
+		// what the version stored moves into the next one
+		moved, deleted, err := db.PlanDelete(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := []string{"/a", "/b", "/d"}; !reflect.DeepEqual(moved, expected) {
+			t.Errorf("expected %v to move, got %v", expected, moved)
+		}
+
+		if expected := []string{"/d/x"}; !reflect.DeepEqual(deleted, expected) {
+			t.Errorf("expected %v to be deleted, got %v", expected, deleted)
+		}
+
+		if err := db.Delete(2); err != nil {
+			t.Fatal(err)
+		}
+
+		// deleting the head drops its changes
+		if err := db.Delete(3); err != nil {
+			t.Fatal(err)
+		}
+
+		after := readVersions(t, db)
+		if len(after) != 2 {
+			t.Fatalf("expected 2 versions, got %d", len(after))
+		}
+
+		compareTrees(t, "first", before[0], after[0])
+		compareTrees(t, "third", before[2], after[1])
+	})
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+//
+//	Change
+//
+
+type Change struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	Dir    bool   `json:"dir"`
+	Patch  string `json:"patch,omitempty"`
+	old    *Node
+	new    *Node
+}
+
+func (c Change) String() string {
+	if c.Dir {
+		return fmt.Sprintf("%s\t%s/", c.Change, c.Path)
+	}
+
+	return fmt.Sprintf("%s\t%s", c.Change, c.Path)
+}
+
+//
+//	verDiff
+//
+
+type verDiff struct {
+	from    *Version
+	to      *Version
+	vers    verList
+	changes []Change
+}
+
+// Diff lists the changes between two versions given by index (0 for head).
+func (db *Database) Diff(from, to uint) ([]Change, error) {
+	if from > uint(len(db.vers)) || to > uint(len(db.vers)) || len(db.vers) == 0 {
+		return nil, errors.New("invalid version index")
+	}
+
+	if from == 0 {
+		from = uint(len(db.vers))
+	}
+
+	if to == 0 {
+		to = uint(len(db.vers))
+	}
+
+	lo, hi := from, to
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	diff := &verDiff{from: db.vers[from-1], to: db.vers[to-1], vers: db.vers[lo:hi]}
+	if err := diff.diffDir("/"); err != nil {
+		return nil, err
+	}
+
+	return diff.changes, nil
+}
+
+func (d *verDiff) touched(path string) bool {
+	for _, ver := range d.vers {
+		if ver.touches(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *verDiff) diffDir(path string) error {
+	oldNodes, err := d.from.scanDir(path)
+	if err != nil {
+		return err
+	}
+
+	newNodes, err := d.to.scanDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range mergeNames(oldNodes, newNodes) {
+		oldNode, newNode := oldNodes[name], newNodes[name]
+
+		switch {
+		case newNode == nil:
+			if err := d.addTree(d.from, oldNode, "removed"); err != nil {
+				return err
+			}
+		case oldNode == nil:
+			if err := d.addTree(d.to, newNode, "added"); err != nil {
+				return err
+			}
+		case oldNode.flags&NodeFlagDir != newNode.flags&NodeFlagDir:
+			if err := d.addTree(d.from, oldNode, "removed"); err != nil {
+				return err
+			}
+
+			if err := d.addTree(d.to, newNode, "added"); err != nil {
+				return err
+			}
+		default:
+			change, err := compareNodes(oldNode, newNode)
+			if err != nil {
+				return err
+			}
+
+			isDir := newNode.flags&NodeFlagDir == NodeFlagDir
+			if change != "" {
+				d.changes = append(d.changes, Change{Path: newNode.path, Change: change, Dir: isDir, old: oldNode, new: newNode})
+			}
+
+			if isDir && (!oldNode.same(newNode) || d.touched(newNode.path)) {
+				if err := d.diffDir(newNode.path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *verDiff) addTree(ver *Version, node *Node, change string) error {
+	isDir := node.flags&NodeFlagDir == NodeFlagDir
+	if change == "removed" {
+		d.changes = append(d.changes, Change{Path: node.path, Change: change, Dir: isDir, old: node})
+	} else {
+		d.changes = append(d.changes, Change{Path: node.path, Change: change, Dir: isDir, new: node})
+	}
+
+	if !isDir {
+		return nil
+	}
+
+	nodes, err := ver.scanDir(node.path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range mergeNames(nodes, nil) {
+		if err := d.addTree(ver, nodes[name], change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mergeNames(a, b verNodeMap) []string {
+	var names []string
+	for name := range a {
+		names = append(names, name)
+	}
+
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func compareNodes(oldNode, newNode *Node) (string, error) {
+	if oldNode.same(newNode) {
+		return "", nil
+	}
+
+	backend := oldNode.ver.db.backend
+
+	oldInfo, err := backend.Lstat(oldNode.rebasedPath())
+	if err != nil {
+		return "", err
+	}
+
+	newInfo, err := backend.Lstat(newNode.rebasedPath())
+	if err != nil {
+		return "", err
+	}
+
+	oldAttr, err := backendAttr(backend, oldNode.rebasedPath())
+	if err != nil {
+		return "", err
+	}
+
+	newAttr, err := backendAttr(backend, newNode.rebasedPath())
+	if err != nil {
+		return "", err
+	}
+
+	if oldInfo.IsDir() {
+		if oldAttr.mode != newAttr.mode || oldAttr.uid != newAttr.uid || oldAttr.gid != newAttr.gid {
+			return "attributes", nil
+		}
+
+		return "", nil
+	}
+
+	if oldInfo.Size() != newInfo.Size() || oldInfo.Mode()&os.ModeType != newInfo.Mode()&os.ModeType {
+		return "modified", nil
+	}
+
+	if oldInfo.Mode()&os.ModeSymlink != 0 {
+		oldTarget, err := backend.Readlink(oldNode.rebasedPath())
+		if err != nil {
+			return "", err
+		}
+
+		newTarget, err := backend.Readlink(newNode.rebasedPath())
+		if err != nil {
+			return "", err
+		}
+
+		if oldTarget != newTarget {
+			return "modified", nil
+		}
+	} else if oldInfo.Mode().IsRegular() {
+		same, err := sameContent(backend, oldNode.rebasedPath(), backend, newNode.rebasedPath())
+		if err != nil {
+			return "", err
+		}
+
+		if !same {
+			return "modified", nil
+		}
+	}
+
+	if oldAttr.mode != newAttr.mode || oldAttr.uid != newAttr.uid || oldAttr.gid != newAttr.gid || !oldAttr.mtime.Equal(newAttr.mtime) {
+		return "attributes", nil
+	}
+
+	return "", nil
+}
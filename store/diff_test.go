@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+		writeFile(t, db, "/b", "b")
+		writeFile(t, db, "/d/x", "x")
+		writeFile(t, db, "/m", "m")
+		writeFile(t, db, "/t", "t")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/a", "two")
+		removeAll(t, db, "/b")
+		writeFile(t, db, "/c", "c")
+		removeAll(t, db, "/d")
+		_, file := db.Root().Child("m")
+		if _, err := file.SetAttr(Attr{Mode: 0600}, AttrMode); err != nil {
+			t.Fatal(err)
+		}
+		removeAll(t, db, "/t")
+		writeFile(t, db, "/t/y", "y")
+		unmount(t, db)
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		diff := func(from, to uint) []string {
+			changes, err := db.Diff(from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lines []string
+			for _, change := range changes {
+				switch change.Change {
+				case "added":
+					if change.old != nil || change.new == nil {
+						t.Errorf("added %s should only carry the new node", change.Path)
+					}
+				case "removed":
+					if change.old == nil || change.new != nil {
+						t.Errorf("removed %s should only carry the old node", change.Path)
+					}
+				}
+
+				lines = append(lines, change.String())
+			}
+
+			return lines
+		}
+
+		forward := []string{
+			"modified\t/a",
+			"removed\t/b",
+			"added\t/c",
+			"removed\t/d/",
+			"removed\t/d/x",
+			"attributes\t/m",
+			"removed\t/t",
+			"added\t/t/",
+			"added\t/t/y",
+		}
+
+		if lines := diff(1, 2); !reflect.DeepEqual(lines, forward) {
+			t.Errorf("expected %q, got %q", forward, lines)
+		}
+
+		backward := []string{
+			"modified\t/a",
+			"added\t/b",
+			"removed\t/c",
+			"added\t/d/",
+			"added\t/d/x",
+			"attributes\t/m",
+			"removed\t/t/",
+			"removed\t/t/y",
+			"added\t/t",
+		}
+
+		// index 0 stands for the head
+		if lines := diff(0, 1); !reflect.DeepEqual(lines, backward) {
+			t.Errorf("expected %q, got %q", backward, lines)
+		}
+
+		if lines := diff(2, 2); len(lines) != 0 {
+			t.Errorf("expected no changes between a version and itself, got %q", lines)
+		}
+
+		if _, err := db.Diff(1, 3); err == nil {
+			t.Error("compared against a version past the head")
+		}
+	})
+}
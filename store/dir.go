@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+//
+//	Dir
+//
+
+type Dir struct {
+	dirs   map[string]*Dir
+	files  map[string]*File
+	node   *Node
+	inode  uint64
+	parent *Dir
+	mutex  sync.Mutex
+}
+
+func newDir(node *Node, parent *Dir) *Dir {
+	dirs := make(map[string]*Dir)
+	files := make(map[string]*File)
+
+	return &Dir{dirs, files, node, allocInode(), parent, sync.Mutex{}}
+}
+
+func (vd *Dir) version() error {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	if vd.node.versioned() {
+		return nil
+	}
+
+	node := newNode(vd.node.path, vd.node.ver.db.lastVer(), vd.node, NodeFlagDir|NodeFlagNew)
+	if err := mkdirAll(node.ver.db.backend, node.rebasedPath(), 0755); err != nil {
+		return err
+	}
+
+	vd.node = node
+	return node.ver.meta.modifyNode(node.path)
+}
+
+func (vd *Dir) CreateDir(name string) (*Dir, error) {
+	vd.node.ver.db.beginChange()
+	defer vd.node.ver.db.endChange()
+
+	if err := vd.version(); err != nil {
+		return nil, err
+	}
+
+	childPath := path.Join(vd.node.path, name)
+	if err := vd.node.ver.db.backend.Mkdir(vd.node.ver.rebasePath(childPath), 0755); err != nil {
+		return nil, err
+	}
+
+	node := newNode(childPath, vd.node.ver, nil, NodeFlagDir|NodeFlagNew)
+	dir := newDir(node, vd)
+
+	vd.mutex.Lock()
+	vd.dirs[name] = dir
+	vd.mutex.Unlock()
+
+	if err := node.ver.meta.createNode(node.path); err != nil {
+		return nil, err
+	}
+
+	node.ver.db.touch(0)
+
+	return dir, nil
+}
+
+func (vd *Dir) CreateFile(name string, flags int, mode os.FileMode) (*File, *Handle, error) {
+	vd.node.ver.db.beginChange()
+	defer vd.node.ver.db.endChange()
+
+	if err := vd.version(); err != nil {
+		return nil, nil, err
+	}
+
+	childPath := path.Join(vd.node.path, name)
+	node := newNode(childPath, vd.node.ver, nil, NodeFlagNew)
+	file := newFile(node, vd)
+
+	handle, err := file.open(flags, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vd.mutex.Lock()
+	vd.files[name] = file
+	vd.mutex.Unlock()
+
+	if err := node.ver.meta.createNode(node.path); err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+
+	node.ver.db.touch(0)
+
+	return file, handle, nil
+}
+
+func (vd *Dir) removeChild(node *Node) error {
+	if !node.versioned() {
+		return vd.node.ver.meta.removeNode(node.path)
+	}
+
+	if err := node.ver.db.backend.Remove(node.rebasedPath()); err != nil {
+		return err
+	}
+
+	// a copy written by the head may shadow the entry of an earlier version,
+	// which then has to be deleted as well
+	nodes, err := node.ver.scanDir(vd.node.path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := nodes[path.Base(node.path)]; ok {
+		return vd.node.ver.meta.removeNode(node.path)
+	}
+
+	return nil
+}
+
+func (vd *Dir) RemoveDir(name string) error {
+	vd.node.ver.db.beginChange()
+	defer vd.node.ver.db.endChange()
+
+	if err := vd.version(); err != nil {
+		return err
+	}
+
+	if err := vd.removeChild(vd.dirs[name].node); err != nil {
+		return err
+	}
+
+	vd.mutex.Lock()
+	delete(vd.dirs, name)
+	vd.mutex.Unlock()
+
+	vd.node.ver.db.touch(0)
+	return nil
+}
+
+func (vd *Dir) RemoveFile(name string) error {
+	vd.node.ver.db.beginChange()
+	defer vd.node.ver.db.endChange()
+
+	if err := vd.version(); err != nil {
+		return err
+	}
+
+	if err := vd.removeChild(vd.files[name].node); err != nil {
+		return err
+	}
+
+	vd.mutex.Lock()
+	delete(vd.files, name)
+	vd.mutex.Unlock()
+
+	vd.node.ver.db.touch(0)
+	return nil
+}
+
+func (vd *Dir) Attr() (Attr, error) {
+	attr, err := vd.node.attr()
+	if err != nil {
+		return Attr{}, err
+	}
+
+	attr.Inode = vd.inode
+	return attr, nil
+}
+
+func (vd *Dir) SetAttr(attr Attr, valid int) (Attr, error) {
+	vd.node.ver.db.beginChange()
+	defer vd.node.ver.db.endChange()
+
+	vd.version()
+
+	result, err := vd.node.setAttr(attr, valid)
+	result.Inode = vd.inode
+	return result, err
+}
+
+func (vd *Dir) Child(name string) (*Dir, *File) {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	return vd.dirs[name], vd.files[name]
+}
+
+func (vd *Dir) Entries() []Entry {
+	vd.mutex.Lock()
+	defer vd.mutex.Unlock()
+
+	entries := []Entry{{Name: ".", Inode: vd.inode, Dir: true}}
+	if vd.parent != nil {
+		entries = append(entries, Entry{Name: "..", Inode: vd.parent.inode, Dir: true})
+	}
+
+	for name, dir := range vd.dirs {
+		entries = append(entries, Entry{Name: name, Inode: dir.inode, Dir: true})
+	}
+
+	for name, file := range vd.files {
+		entries = append(entries, Entry{Name: name, Inode: file.inode})
+	}
+
+	return entries
+}
+
+func (vd *Dir) Node() *Node {
+	return vd.node
+}
+
+func (vd *Dir) Inode() uint64 {
+	return vd.inode
+}
+
+//
+//	Entry
+//
+
+type Entry struct {
+	Name  string
+	Inode uint64
+	Dir   bool
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import "testing"
+
+func TestRemoveShadowing(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "v1")
+		writeFile(t, db, "/d/x", "v1")
+		unmount(t, db)
+
+		// copies written by the head shadow the entries of the first version
+		mount(t, db)
+		writeFile(t, db, "/a", "v2")
+		writeFile(t, db, "/d/x", "v2")
+		removeAll(t, db, "/a")
+		removeAll(t, db, "/d")
+		unmount(t, db)
+
+		// entries only ever written by the head leave nothing behind
+		mount(t, db)
+		writeFile(t, db, "/tmp/x", "scratch")
+		removeAll(t, db, "/tmp")
+		unmount(t, db)
+
+		trees := readVersions(t, db)
+		if len(trees) != 2 {
+			t.Fatalf("expected 2 versions, got %d", len(trees))
+		}
+
+		compareTrees(t, "removed", map[string]string{"/": "dir"}, trees[1])
+	})
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const whiteoutPrefix = ".wh."
+
+//
+//	verExport
+//
+
+type verExport struct {
+	ver     *Version
+	delta   bool
+	include map[string]bool
+	writer  *tar.Writer
+}
+
+// Export writes a version as a tar archive; with delta set, only the changes
+// introduced by the version are written, deletions as whiteout entries.
+func (db *Database) Export(index uint, delta bool, w io.Writer) error {
+	if index > uint(len(db.vers)) || len(db.vers) == 0 {
+		return errors.New("invalid version index")
+	}
+
+	if index == 0 {
+		index = uint(len(db.vers))
+	}
+
+	ver := db.vers[index-1]
+	if err := ver.resolve(); err != nil {
+		return err
+	}
+
+	e := &verExport{ver: ver, delta: delta, writer: tar.NewWriter(w)}
+	if delta {
+		e.include = make(map[string]bool)
+		ver.root.Walk(func(node *Node) error {
+			if e.changed(node) {
+				e.includePath(node.path)
+			}
+
+			return nil
+		})
+
+		for _, name := range e.deleted() {
+			e.includePath(path.Dir(name))
+		}
+	}
+
+	if err := ver.root.Walk(e.writeNode); err != nil {
+		return err
+	}
+
+	if delta {
+		for _, name := range e.deleted() {
+			if err := e.writeWhiteout(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return e.writer.Close()
+}
+
+func (e *verExport) changed(node *Node) bool {
+	if node.ver == e.ver {
+		return true
+	}
+
+	for refPath := range e.ver.meta.refs {
+		if isSubPath(node.path, refPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *verExport) includePath(name string) {
+	e.include[name] = true
+	for _, dir := range parentPaths(name) {
+		e.include[dir] = true
+	}
+}
+
+func (e *verExport) deleted() []string {
+	var paths []string
+	for name, deleted := range e.ver.meta.deleted {
+		if deleted {
+			paths = append(paths, name)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func (e *verExport) writeNode(node *Node) error {
+	if node.path == "/" || (e.delta && !e.include[node.path]) {
+		return nil
+	}
+
+	backend := node.ver.db.backend
+
+	info, err := backend.Lstat(node.rebasedPath())
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = backend.Readlink(node.rebasedPath()); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = strings.TrimPrefix(node.path, "/")
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Format = tar.FormatPAX
+
+	if store, ok := backend.(xattrStore); ok && info.Mode()&os.ModeSymlink == 0 {
+		xattrs, err := store.ReadXattrs(node.rebasedPath())
+		if err != nil {
+			return err
+		}
+
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+
+			hdr.PAXRecords["SCHILY.xattr."+name] = value
+		}
+	}
+
+	if err := e.writer.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := backend.Open(node.rebasedPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(e.writer, file)
+	return err
+}
+
+func (e *verExport) writeWhiteout(name string) error {
+	hdr := &tar.Header{
+		Name:     strings.TrimPrefix(path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)), "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  e.ver.timestamp,
+		Format:   tar.FormatPAX,
+	}
+
+	return e.writer.WriteHeader(hdr)
+}
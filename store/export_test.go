@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+		writeFile(t, db, "/d/x", "x")
+		writeFile(t, db, "/d/z", "z")
+		writeFile(t, db, "/e/f", "f")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/a", "two")
+		writeFile(t, db, "/b", "b")
+		removeAll(t, db, "/d/x")
+		unmount(t, db)
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		// export describes each archive entry as "dir" or "file:<contents>",
+		// keeping the order in which they were written.
+		export := func(index uint, delta bool) []string {
+			var buf bytes.Buffer
+			if err := db.Export(index, delta, &buf); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries []string
+			reader := tar.NewReader(&buf)
+			for {
+				hdr, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if hdr.Typeflag == tar.TypeDir {
+					entries = append(entries, hdr.Name+" dir")
+					continue
+				}
+
+				data, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				entries = append(entries, hdr.Name+" file:"+string(data))
+			}
+
+			return entries
+		}
+
+		tests := []struct {
+			index    uint
+			delta    bool
+			expected []string
+		}{
+			{1, false, []string{"a file:one", "d/ dir", "d/x file:x", "d/z file:z", "e/ dir", "e/f file:f"}},
+			{0, false, []string{"a file:two", "b file:b", "d/ dir", "d/z file:z", "e/ dir", "e/f file:f"}},
+			{1, true, []string{"a file:one", "d/ dir", "d/x file:x", "d/z file:z", "e/ dir", "e/f file:f"}},
+			{2, true, []string{"a file:two", "b file:b", "d/ dir", "d/.wh.x file:"}},
+		}
+
+		for _, test := range tests {
+			if entries := export(test.index, test.delta); !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("export %d (delta %v): expected %q, got %q", test.index, test.delta, test.expected, entries)
+			}
+		}
+
+		if err := db.Export(3, false, ioutil.Discard); err == nil {
+			t.Error("exported a version past the head")
+		}
+	})
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var ErrCorrupt = errors.New("stored data does not match its checksum")
+
+//
+//	File
+//
+
+type File struct {
+	node    *Node
+	inode   uint64
+	parent  *Dir
+	handles map[*Handle]bool
+	mutex   sync.Mutex
+}
+
+func newFile(node *Node, parent *Dir) *File {
+	return &File{node, allocInode(), parent, make(map[*Handle]bool), sync.Mutex{}}
+}
+
+func (vf *File) version() error {
+	if err := vf.parent.version(); err != nil {
+		return err
+	}
+
+	vf.mutex.Lock()
+	defer vf.mutex.Unlock()
+
+	if vf.node.versioned() {
+		return nil
+	}
+
+	node := newNode(vf.node.path, vf.node.ver.db.lastVer(), vf.node, NodeFlagNew)
+	if _, err := copyFile(vf.node.ver.db.backend, vf.node.rebasedPath(), node.rebasedPath()); err != nil {
+		return err
+	}
+
+	vf.node = node
+	return node.ver.meta.modifyNode(node.path)
+}
+
+func (vf *File) verify() error {
+	limit := vf.node.ver.db.verify
+	if limit <= 0 {
+		return nil
+	}
+
+	// files created or written since the version was finalized have no
+	// checksum yet
+	if _, ok := vf.node.ver.meta.sum(vf.node.path); !ok {
+		return nil
+	}
+
+	info, err := vf.node.ver.db.backend.Lstat(vf.node.rebasedPath())
+	if err != nil {
+		return err
+	}
+
+	if info.Size() >= limit {
+		return nil
+	}
+
+	if err := vf.node.ver.verifySum(vf.node.path); err != nil {
+		log.Print(err)
+		return ErrCorrupt
+	}
+
+	return nil
+}
+
+func (vf *File) Open(flags int, mode os.FileMode) (*Handle, error) {
+	if flags&syscall.O_ACCMODE != os.O_RDONLY {
+		vf.node.ver.db.beginChange()
+		defer vf.node.ver.db.endChange()
+	}
+
+	return vf.open(flags, mode)
+}
+
+func (vf *File) open(flags int, mode os.FileMode) (*Handle, error) {
+	if err := vf.verify(); err != nil {
+		return nil, err
+	}
+
+	writable := flags&syscall.O_ACCMODE != os.O_RDONLY
+	if writable {
+		vf.node.ver.db.beginWrite()
+		if err := vf.version(); err != nil {
+			vf.node.ver.db.endWrite()
+			return nil, err
+		}
+	}
+
+	path := vf.node.rebasedPath()
+
+	handle, err := vf.node.ver.db.backend.OpenFile(path, flags, mode)
+	if err != nil {
+		if writable {
+			vf.node.ver.db.endWrite()
+		}
+
+		return nil, err
+	}
+
+	verHandle := &Handle{vf, path, handle, writable, sync.Mutex{}}
+
+	vf.mutex.Lock()
+	vf.handles[verHandle] = true
+	vf.mutex.Unlock()
+
+	vf.node.ver.db.addHandle(verHandle)
+
+	return verHandle, nil
+}
+
+func (vf *File) release(handle *Handle) {
+	vf.mutex.Lock()
+	delete(vf.handles, handle)
+	vf.mutex.Unlock()
+}
+
+func (vf *File) Attr() (Attr, error) {
+	attr, err := vf.node.attr()
+	attr.Inode = vf.inode
+	return attr, err
+}
+
+func (vf *File) SetAttr(attr Attr, valid int) (Attr, error) {
+	vf.node.ver.db.beginChange()
+	defer vf.node.ver.db.endChange()
+
+	if err := vf.version(); err != nil {
+		return Attr{}, err
+	}
+
+	result, err := vf.node.setAttr(attr, valid)
+	result.Inode = vf.inode
+	return result, err
+}
+
+func (vf *File) Sync() error {
+	vf.mutex.Lock()
+	defer vf.mutex.Unlock()
+
+	for handle := range vf.handles {
+		if err := handle.sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vf *File) Node() *Node {
+	return vf.node
+}
+
+func (vf *File) Inode() uint64 {
+	return vf.inode
+}
+
+//
+//	Handle
+//
+
+type Handle struct {
+	node     *File
+	path     string
+	handle   BackendFile
+	writable bool
+	mutex    sync.Mutex
+}
+
+func (vfh *Handle) sync() error {
+	vfh.mutex.Lock()
+	defer vfh.mutex.Unlock()
+
+	if vfh.handle == nil || !vfh.writable {
+		return nil
+	}
+
+	return vfh.handle.Sync()
+}
+
+func (vfh *Handle) ReadAt(data []byte, offset int64) (int, error) {
+	return vfh.handle.ReadAt(data, offset)
+}
+
+func (vfh *Handle) ReadAll() ([]byte, error) {
+	return ioutil.ReadAll(vfh.handle)
+}
+
+func (vfh *Handle) WriteAt(data []byte, offset int64) (int, error) {
+	size, err := vfh.handle.WriteAt(data, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	vfh.node.node.ver.db.touch(size)
+	return size, nil
+}
+
+func (vfh *Handle) Close() error {
+	vfh.node.node.ver.db.removeHandle(vfh)
+
+	vfh.mutex.Lock()
+	err := vfh.handle.Close()
+	vfh.handle = nil
+	vfh.mutex.Unlock()
+
+	if vfh.writable {
+		vfh.node.node.ver.db.endWrite()
+	}
+
+	vfh.node.release(vfh)
+	return err
+}
@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+//	fsck
+//
+
+type fsck struct {
+	db       *Database
+	repair   bool
+	notify   func(name, problem string, repaired bool)
+	problems int
+	repaired int
+	files    map[string][]int
+}
+
+func (f *fsck) report(name, problem string, repair func() error) error {
+	if !f.repair || repair == nil {
+		f.notify(name, problem, false)
+		f.problems++
+		return nil
+	}
+
+	if err := repair(); err != nil {
+		return err
+	}
+
+	f.notify(name, problem, true)
+	f.repaired++
+	return nil
+}
+
+func (f *fsck) lostFound(name string) func() error {
+	return func() error {
+		dir := path.Join(".vfs", "lost+found")
+		if err := mkdirAll(f.db.backend, dir, 0755); err != nil {
+			return err
+		}
+
+		return f.db.backend.Rename(name, path.Join(dir, name))
+	}
+}
+
+func (f *fsck) scanVers() (verList, error) {
+	infos, err := f.db.backend.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var vers verList
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		timestamp, err := parseVerName(name)
+		if err != nil {
+			if err := f.report(name, "not a version directory", f.lostFound(name)); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		ver, err := f.loadVer(name, timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		vers = append(vers, ver)
+	}
+
+	sort.Stable(vers)
+
+	for i := 1; i < len(vers); i++ {
+		if vers[i].timestamp.Equal(vers[i-1].timestamp) {
+			problem := fmt.Sprintf("timestamp duplicates %s", vers[i-1].name())
+			if err := f.report(vers[i].name(), problem, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var pv *Version
+	for _, ver := range vers {
+		ver.parent = pv
+		pv = ver
+	}
+
+	return vers, nil
+}
+
+func (f *fsck) loadVer(name string, timestamp time.Time) (*Version, error) {
+	backend := f.db.backend
+	metaPath := path.Join(name, "meta.json")
+
+	meta, err := newVerMeta(backend, metaPath, f.db.AreaPath("journals", name))
+	if err != nil {
+		problem := fmt.Sprintf("malformed meta.json (%s)", err)
+		// metadata is not always stored as a plain file, so it is set aside
+		// through the calls that wrote it
+		repair := func() error {
+			data, err := backend.ReadMeta(metaPath)
+			if err != nil {
+				return err
+			}
+
+			if err := backend.WriteMeta(metaPath+".corrupt", data); err != nil {
+				return err
+			}
+
+			return backend.RemoveAll(metaPath)
+		}
+		if err := f.report(name, problem, repair); err != nil {
+			return nil, err
+		}
+
+		meta = &verMeta{backend: backend, path: metaPath, journalPath: f.db.AreaPath("journals", name), deleted: make(map[string]bool), refs: make(map[string]string), sums: make(map[string]string)}
+	}
+
+	ver := &Version{name, nil, timestamp, meta, nil, f.db}
+
+	info, err := backend.Stat(ver.rebasePath())
+	switch {
+	case os.IsNotExist(err):
+		repair := func() error { return backend.Mkdir(ver.rebasePath(), 0755) }
+		if err := f.report(name, "missing root directory", repair); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case !info.IsDir():
+		if err := f.report(name, "root is not a directory", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ver, nil
+}
+
+func (f *fsck) scanFiles(vers verList) error {
+	f.files = make(map[string][]int)
+
+	for index, ver := range vers {
+		if info, err := f.db.backend.Stat(ver.rebasePath()); err != nil || !info.IsDir() {
+			continue
+		}
+
+		err := walkTree(f.db.backend, ver.rebasePath(), func(path string, info os.FileInfo) error {
+			if !info.IsDir() {
+				f.files[path] = append(f.files[path], index)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fsck) checkRefs(ver *Version) error {
+	var paths []string
+	for path := range ver.meta.refs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		refName := ver.meta.refs[path]
+		unref := func() error {
+			if err := ver.meta.unrefNode(path); err != nil {
+				return err
+			}
+
+			return ver.meta.save()
+		}
+
+		refVer := ver.ancestor(refName)
+		if refVer == nil {
+			if err := f.report(ver.name(), fmt.Sprintf("reference %s points at missing version %s", path, refName), unref); err != nil {
+				return err
+			}
+		} else if _, err := f.db.backend.Lstat(refVer.rebasePath(path)); os.IsNotExist(err) {
+			if err := f.report(ver.name(), fmt.Sprintf("reference %s points at missing data in %s", path, refName), unref); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *fsck) checkDeleted(ver *Version) error {
+	var paths []string
+	for name, deleted := range ver.meta.deleted {
+		if deleted {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, name := range paths {
+		// versions that cannot be resolved are reported on their own
+		nodes, err := ver.parent.scanDir(path.Dir(name))
+		if err != nil {
+			continue
+		}
+
+		if _, ok := nodes[path.Base(name)]; ok {
+			continue
+		}
+
+		undelete := func() error {
+			if err := ver.meta.undeleteNode(name); err != nil {
+				return err
+			}
+
+			return ver.meta.save()
+		}
+
+		if err := f.report(ver.name(), fmt.Sprintf("deletion record %s points at nothing", name), undelete); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fsck) checkConflicts(vers verList, index int, root *Dir, reported map[string]bool) error {
+	ver := vers[index]
+
+	indices := make(map[*Version]int)
+	for i, v := range vers {
+		indices[v] = i
+	}
+
+	var conflicts []*Node
+	root.Walk(func(node *Node) error {
+		for _, conflict := range conflicts {
+			if isSubPath(node.path, conflict.path) {
+				return nil
+			}
+		}
+
+		owner := indices[node.ver]
+		for _, dir := range parentPaths(node.path) {
+			for _, fileIndex := range f.files[dir] {
+				if fileIndex > owner && fileIndex <= index {
+					conflicts = append(conflicts, node)
+					return nil
+				}
+			}
+		}
+
+		return nil
+	})
+
+	for _, node := range conflicts {
+		key := fmt.Sprintf("%s:%s", node.ver.name(), node.path)
+		if reported[key] {
+			continue
+		}
+		reported[key] = true
+
+		remove := func() error {
+			if err := ver.meta.removeNode(node.path); err != nil {
+				return err
+			}
+
+			return ver.meta.save()
+		}
+
+		problem := fmt.Sprintf("%s from %s reappears after a parent directory was replaced by a file", node.path, node.ver.name())
+		if err := f.report(ver.name(), problem, remove); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fsck) run() error {
+	if err := f.db.checkFormat(); err != nil {
+		return err
+	}
+
+	vers, err := f.scanVers()
+	if err != nil {
+		return err
+	}
+
+	if err := f.scanFiles(vers); err != nil {
+		return err
+	}
+
+	reported := make(map[string]bool)
+
+	for index, ver := range vers {
+		if err := f.checkRefs(ver); err != nil {
+			return err
+		}
+
+		if ver.parent != nil {
+			if err := f.checkDeleted(ver); err != nil {
+				return err
+			}
+		}
+
+		root, err := ver.build()
+		if err != nil {
+			if err := f.report(ver.name(), fmt.Sprintf("cannot be resolved (%s)", err), nil); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := f.checkConflicts(vers, index, root, reported); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fsck checks the database for problems, repairing what it can if asked to,
+// and calls notify for each problem found.
+func (db *Database) Fsck(repair bool, notify func(name, problem string, repaired bool)) (problems, repaired int, err error) {
+	f := &fsck{db: db, repair: repair, notify: notify}
+	if err := f.run(); err != nil {
+		return f.problems, f.repaired, err
+	}
+
+	return f.problems, f.repaired, nil
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// editMeta rewrites the stored metadata of a version behind its back.
+func editMeta(t *testing.T, db *Database, ver *Version, edit func(vf *verFmt)) {
+	name := path.Join(ver.Name(), "meta.json")
+
+	var vf verFmt
+	if data, err := db.backend.ReadMeta(name); err == nil {
+		if err := json.Unmarshal(data, &vf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edit(&vf)
+
+	data, err := json.Marshal(vf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.backend.WriteMeta(name, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		for _, name := range []string{"/a", "/b", "/c", "/d"} {
+			mount(t, db)
+			writeFile(t, db, name, name)
+			unmount(t, db)
+		}
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		vers := db.Versions()
+		if err := db.backend.WriteMeta(path.Join(vers[0].Name(), "meta.json"), []byte("{")); err != nil {
+			t.Fatal(err)
+		}
+
+		editMeta(t, db, vers[1], func(vf *verFmt) {
+			vf.Deleted = append(vf.Deleted, "/nothing")
+		})
+
+		editMeta(t, db, vers[2], func(vf *verFmt) {
+			vf.Refs = map[string]string{"/a": "missing"}
+		})
+
+		if err := db.backend.RemoveAll(vers[3].rebasePath()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mkdirAll(db.backend, "photos", 0755); err != nil {
+			t.Fatal(err)
+		}
+		putFile(t, db.backend, "photos/notes.txt", "foreign")
+
+		// the version with the broken reference, and the one built on it,
+		// cannot be resolved until the reference is dropped
+		expected := []string{
+			"photos: not a version directory",
+			vers[0].Name() + ": malformed meta.json",
+			vers[3].Name() + ": missing root directory",
+			vers[1].Name() + ": deletion record /nothing points at nothing",
+			vers[2].Name() + ": reference /a points at missing version missing",
+			vers[2].Name() + ": cannot be resolved",
+			vers[3].Name() + ": cannot be resolved",
+		}
+
+		fsck := func(repair bool) []string {
+			var reported []string
+			problems, repaired, err := db.Fsck(repair, func(name, problem string, wasRepaired bool) {
+				reported = append(reported, name+": "+problem)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if problems+repaired != len(reported) {
+				t.Errorf("%d problems and %d repairs counted, %d reported", problems, repaired, len(reported))
+			}
+
+			return reported
+		}
+
+		compare := func(label string, expected, reported []string) {
+			if len(reported) != len(expected) {
+				t.Errorf("%s: expected %q, got %q", label, expected, reported)
+				return
+			}
+
+			for i := range expected {
+				if !strings.HasPrefix(reported[i], expected[i]) {
+					t.Errorf("%s: expected %q, got %q", label, expected[i], reported[i])
+				}
+			}
+		}
+
+		compare("check", expected, fsck(false))
+		compare("repair", expected[:5], fsck(true))
+
+		if reported := fsck(false); len(reported) != 0 {
+			t.Errorf("problems remain after repairing: %q", reported)
+		}
+
+		if data := getFile(t, db.backend, ".vfs/lost+found/photos/notes.txt"); data != "foreign" {
+			t.Errorf("lost+found holds %q", data)
+		}
+
+		if _, err := db.backend.ReadMeta(path.Join(vers[0].Name(), "meta.json.corrupt")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// Users and other tools may leave their own files in the database directory
+// and in the .vfs area; they are reported at most, and never touched.
+func TestForeignEntries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/f", "one")
+		unmount(t, db)
+
+		hostFiles := []string{
+			db.AreaPath("notes.txt"),
+			db.AreaPath("extra", "notes.txt"),
+			db.AreaPath("journals", "notes.txt"),
+		}
+
+		backendFiles := []string{
+			"README",
+			".hidden/notes.txt",
+			"photos/notes.txt",
+			stagePath("notes.txt"),
+			stagePath("notes.json"),
+			stagePath("notes.squash", "notes.txt"),
+		}
+
+		for _, name := range hostFiles {
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(name, []byte("foreign"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range backendFiles {
+			if err := mkdirAll(db.backend, filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			putFile(t, db.backend, name, "foreign")
+		}
+
+		expected := map[string]string{"/": "dir", "/f": "file:one"}
+		for _, tree := range readVersions(t, db) {
+			compareTrees(t, "read", expected, tree)
+		}
+
+		writer := reopen(t, db)
+		mount(t, writer)
+		compareTrees(t, "mounted", expected, readTree(t, writer.Root()))
+		writeFile(t, writer, "/g", "two")
+		unmount(t, writer)
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		var reported []string
+		problems, _, err := db.Fsck(false, func(name, problem string, repaired bool) {
+			reported = append(reported, name)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if problems != 1 || len(reported) != 1 || reported[0] != "photos" {
+			t.Errorf("fsck reported %d problems: %v", problems, reported)
+		}
+
+		for _, name := range hostFiles {
+			if data, err := ioutil.ReadFile(name); err != nil || string(data) != "foreign" {
+				t.Errorf("%s reads %q (%v)", name, data, err)
+			}
+		}
+
+		for _, name := range backendFiles {
+			if data, err := readFile(db.backend, name); err != nil || string(data) != "foreign" {
+				t.Errorf("%s reads %q (%v)", name, data, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+//	GcPolicy
+//
+
+type GcPolicy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Tagged  bool
+}
+
+func (p GcPolicy) Enabled() bool {
+	return p.Last > 0 || p.Hourly > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Tagged
+}
+
+// Keep reports which of the versions the policy retains.
+func (p GcPolicy) Keep(vers []*Version) []bool {
+	keep := make([]bool, len(vers))
+	if len(vers) == 0 {
+		return keep
+	}
+
+	keep[len(vers)-1] = true
+
+	for i := len(vers) - 1; i >= 0 && i >= len(vers)-p.Last; i-- {
+		keep[i] = true
+	}
+
+	buckets := []struct {
+		count int
+		key   func(t time.Time) string
+	}{
+		{p.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string { year, week := t.ISOWeek(); return fmt.Sprintf("%d-%d", year, week) }},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	for _, bucket := range buckets {
+		var last string
+		for i, count := len(vers)-1, 0; i >= 0 && count < bucket.count; i-- {
+			if key := bucket.key(vers[i].timestamp); key != last {
+				keep[i] = true
+				last = key
+				count++
+			}
+		}
+	}
+
+	if p.Tagged {
+		for i, ver := range vers {
+			if ver.meta.tag != "" {
+				keep[i] = true
+			}
+		}
+	}
+
+	return keep
+}
+
+//
+//	Database
+//
+
+func (db *Database) prune(keep []bool) error {
+	pruned := make(map[string]bool)
+	for i, ver := range db.vers {
+		if !keep[i] {
+			pruned[ver.name()] = true
+		}
+	}
+
+	for {
+		last := len(db.vers) - 1
+		for last >= 0 && !pruned[db.vers[last].name()] {
+			last--
+		}
+
+		if last < 0 {
+			return nil
+		}
+
+		first := last
+		for first > 0 && pruned[db.vers[first-1].name()] {
+			first--
+		}
+
+		plan, err := db.planSquash(first, last+1)
+		if err != nil {
+			return err
+		}
+
+		if err := plan.apply(); err != nil {
+			return err
+		}
+
+		for _, ver := range db.vers[first : last+1] {
+			delete(pruned, ver.name())
+		}
+
+		if err := db.Load(0); err != nil {
+			return err
+		}
+	}
+}
+
+// Prune merges the versions not marked to be kept into the versions that
+// follow them, verifying that the kept versions still resolve identically.
+func (db *Database) Prune(keep []bool) error {
+	sigs, err := db.buildSigs(keep)
+	if err != nil {
+		return err
+	}
+
+	if err := db.prune(keep); err != nil {
+		return err
+	}
+
+	if err := db.Load(0); err != nil {
+		return err
+	}
+
+	return db.verifySigs(sigs)
+}
+
+func (db *Database) buildSigs(keep []bool) (map[string]treeSig, error) {
+	sigs := make(map[string]treeSig)
+	for i, ver := range db.vers {
+		if !keep[i] {
+			continue
+		}
+
+		if err := ver.resolve(); err != nil {
+			return nil, err
+		}
+
+		sig, err := buildTreeSig(ver.root)
+		if err != nil {
+			return nil, err
+		}
+
+		sigs[ver.name()] = sig
+	}
+
+	return sigs, nil
+}
+
+func (db *Database) verifySigs(sigs map[string]treeSig) error {
+	if len(db.vers) != len(sigs) {
+		return errors.New("unexpected number of versions")
+	}
+
+	for _, ver := range db.vers {
+		expected, ok := sigs[ver.name()]
+		if !ok {
+			return fmt.Errorf("unexpected version: %s", ver.name())
+		}
+
+		if err := ver.resolve(); err != nil {
+			return err
+		}
+
+		actual, err := buildTreeSig(ver.root)
+		if err != nil {
+			return err
+		}
+
+		if paths := expected.diff(actual); len(paths) > 0 {
+			return fmt.Errorf("version %s does not resolve identically: %s", ver.name(), strings.Join(paths, ", "))
+		}
+	}
+
+	return nil
+}
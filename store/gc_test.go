@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGcPolicyKeep(t *testing.T) {
+	base := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	offsets := []time.Duration{0, time.Hour, 25 * time.Hour, 26 * time.Hour, 49 * time.Hour, 49*time.Hour + time.Minute}
+
+	var vers []*Version
+	for i, offset := range offsets {
+		meta := &verMeta{}
+		if i == 0 {
+			meta.tag = "release"
+		}
+
+		vers = append(vers, &Version{timestamp: base.Add(offset), meta: meta})
+	}
+
+	policies := []struct {
+		policy GcPolicy
+		keep   []bool
+	}{
+		{GcPolicy{}, []bool{false, false, false, false, false, true}},
+		{GcPolicy{Last: 2}, []bool{false, false, false, false, true, true}},
+		{GcPolicy{Daily: 2}, []bool{false, false, false, true, false, true}},
+		{GcPolicy{Hourly: 3}, []bool{false, false, true, true, false, true}},
+		{GcPolicy{Tagged: true}, []bool{true, false, false, false, false, true}},
+	}
+
+	for _, p := range policies {
+		if keep := p.policy.Keep(vers); !reflect.DeepEqual(keep, p.keep) {
+			t.Errorf("%+v: kept %v, expected %v", p.policy, keep, p.keep)
+		}
+	}
+}
+
+// Pruning must leave every kept version resolving exactly as before,
+// whichever versions are merged into it.
+func TestPruneResolvesIdentically(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		steps := []func(){
+			func() { writeFile(t, db, "/a/f", "one"); writeFile(t, db, "/b/c", "two") },
+			func() { writeFile(t, db, "/a/f", "three"); removeAll(t, db, "/b") },
+			func() { writeFile(t, db, "/b", "four"); writeFile(t, db, "/e/g", "five") },
+			func() { removeAll(t, db, "/b"); writeFile(t, db, "/b/h", "six") },
+			func() { removeAll(t, db, "/a"); writeFile(t, db, "/e/g", "seven") },
+			func() { writeFile(t, db, "/a/i", "eight") },
+		}
+
+		for _, step := range steps {
+			mount(t, db)
+			step()
+			unmount(t, db)
+		}
+
+		if err := db.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unlock()
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Versions()[1].SetTag("kept", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		trees := readVersions(t, db)
+		names := make(map[string]map[string]string)
+		for i, ver := range db.Versions() {
+			names[ver.Name()] = trees[i]
+		}
+
+		keep := GcPolicy{Last: 1, Tagged: true}.Keep(db.Versions())
+		keep[3] = true
+		if err := db.Prune(keep); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := len(db.Versions()); n != 3 {
+			t.Fatalf("%d versions left", n)
+		}
+
+		for i, tree := range readVersions(t, db) {
+			name := db.Versions()[i].Name()
+			compareTrees(t, name, names[name], tree)
+		}
+
+		problems, _, err := db.Fsck(false, func(name, problem string, repaired bool) { t.Errorf("%s: %s", name, problem) })
+		if err != nil || problems > 0 {
+			t.Errorf("fsck found %d problems: %v", problems, err)
+		}
+	})
+}
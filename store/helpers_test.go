@@ -0,0 +1,290 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testBackend struct {
+	name string
+	open func(t *testing.T, state string) *Database
+}
+
+var testBackends = []testBackend{
+	{"dir", func(t *testing.T, state string) *Database {
+		db, err := Open(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	}},
+	{"memory", func(t *testing.T, state string) *Database {
+		db, err := OpenBackend(state, NewMemoryBackend())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	}},
+	{"s3", func(t *testing.T, state string) *Database {
+		writeS3Config(t, state, newS3Config(t))
+		db, err := Open(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	}},
+}
+
+// forEachBackend runs a test once for every backend, handing it a database
+// opened in a fresh state directory.
+func forEachBackend(t *testing.T, fn func(t *testing.T, db *Database)) {
+	for _, tb := range testBackends {
+		tb := tb
+		t.Run(tb.name, func(t *testing.T) {
+			fn(t, tb.open(t, tempDir(t)))
+		})
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// reopen returns a new handle for the database, as used by a later process.
+func reopen(t *testing.T, db *Database) *Database {
+	other, err := OpenBackend(db.base, db.backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return other
+}
+
+// mount locks the database and starts a new head version the way a writable
+// mount does.
+func mount(t *testing.T, db *Database) {
+	if err := db.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Load(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func unmount(t *testing.T, db *Database) {
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mkdirs(t *testing.T, root *Dir, name string) *Dir {
+	dir := root
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		child, file := dir.Child(part)
+		if file != nil {
+			if err := dir.RemoveFile(part); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if child == nil {
+			var err error
+			if child, err = dir.CreateDir(part); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dir = child
+	}
+
+	return dir
+}
+
+func writeFile(t *testing.T, db *Database, name, data string) {
+	dir := mkdirs(t, db.Root(), path.Dir(name))
+
+	if child, _ := dir.Child(path.Base(name)); child != nil {
+		removeAll(t, db, name)
+	}
+
+	var handle *Handle
+	if _, file := dir.Child(path.Base(name)); file != nil {
+		var err error
+		if handle, err = file.Open(os.O_RDWR|os.O_TRUNC, 0); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		var err error
+		if _, handle, err = dir.CreateFile(path.Base(name), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := handle.WriteAt([]byte(data), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handle.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeAll removes a path the way rm -r does through a mount.
+func removeAll(t *testing.T, db *Database, name string) {
+	parent := db.Root().Lookup(path.Dir(name))
+	if parent == nil {
+		return
+	}
+
+	dir, file := parent.Child(path.Base(name))
+	switch {
+	case dir != nil:
+		for _, entry := range dir.Entries() {
+			if entry.Name != "." && entry.Name != ".." {
+				removeAll(t, db, path.Join(name, entry.Name))
+			}
+		}
+
+		if err := parent.RemoveDir(path.Base(name)); err != nil {
+			t.Fatal(err)
+		}
+	case file != nil:
+		if err := parent.RemoveFile(path.Base(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree describes every entry of a resolved tree as "dir", "link:<target>"
+// or "file:<contents>".
+func readTree(t *testing.T, root *Dir) map[string]string {
+	tree := make(map[string]string)
+
+	err := root.Walk(func(node *Node) error {
+		info, err := node.Stat()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			tree[node.path] = "dir"
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := node.ver.db.backend.Readlink(node.rebasedPath())
+			if err != nil {
+				return err
+			}
+
+			tree[node.path] = "link:" + target
+		default:
+			file, err := node.Open()
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			data, err := ioutil.ReadAll(file)
+			if err != nil {
+				return err
+			}
+
+			tree[node.path] = "file:" + string(data)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+// readVersions resolves every version of a freshly loaded handle.
+func readVersions(t *testing.T, db *Database) []map[string]string {
+	other := reopen(t, db)
+	if err := other.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	var trees []map[string]string
+	for _, ver := range other.Versions() {
+		if err := ver.Resolve(); err != nil {
+			t.Fatal(err)
+		}
+
+		trees = append(trees, readTree(t, ver.Root()))
+	}
+
+	return trees
+}
+
+func compareTrees(t *testing.T, label string, expected, actual map[string]string) {
+	t.Helper()
+
+	var problems []string
+	for name, value := range expected {
+		if actual[name] != value {
+			problems = append(problems, name+": expected "+value+", got "+actual[name])
+		}
+	}
+
+	for name, value := range actual {
+		if _, ok := expected[name]; !ok {
+			problems = append(problems, name+": unexpected "+value)
+		}
+	}
+
+	sort.Strings(problems)
+	for _, problem := range problems {
+		t.Errorf("%s: %s", label, problem)
+	}
+}
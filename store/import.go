@@ -0,0 +1,625 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+//	importEntry
+//
+
+// Entries are read from a stream or from a source file, which is either on
+// the host or, for hard links in archives, already in the database.
+type importEntry struct {
+	path    string
+	attr    fileAttr
+	size    int64
+	link    string
+	source  string
+	backend Backend
+	reader  io.Reader
+	xattrs  map[string]string
+}
+
+func (e *importEntry) isDir() bool {
+	return e.attr.mode.IsDir()
+}
+
+func (e *importEntry) isSymlink() bool {
+	return e.attr.mode&os.ModeSymlink != 0
+}
+
+//
+//	verImport
+//
+
+type ImportOptions struct {
+	Hash    bool
+	Live    bool
+	Tag     string
+	Message string
+}
+
+type verImport struct {
+	ImportOptions
+	head     *Version
+	ver      *Version
+	owners   bool
+	changed  bool
+	seen     map[string]bool
+	seenDirs map[string]bool
+	dirs     map[string]fileAttr
+}
+
+func (db *Database) Import(src string, opts ImportOptions) (*Version, error) {
+	head := db.lastVer()
+	if head != nil {
+		if err := head.resolve(); err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp := time.Now()
+	if err := db.checkTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	dir, err := db.createVerDir(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ver, err := newVer(dir, timestamp, db)
+	if err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	ver.parent = head
+
+	im := &verImport{
+		ImportOptions: opts,
+		head:          head,
+		ver:           ver,
+		owners:        os.Geteuid() == 0,
+		seen:          map[string]bool{"/": true},
+		seenDirs:      map[string]bool{"/": true},
+		dirs:          make(map[string]fileAttr),
+	}
+
+	if err := im.run(src); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	if !im.changed {
+		return nil, db.backend.RemoveAll(dir)
+	}
+
+	if err := ver.meta.setTag(opts.Tag, opts.Message); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	if err := ver.updateSums(); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	if err := ver.meta.save(); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	db.addVer(ver)
+	return ver, nil
+}
+
+func (im *verImport) run(src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = im.walkDir(src)
+	} else {
+		err = im.walkTar(src)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := im.removeMissing(); err != nil {
+		return err
+	}
+
+	return im.applyDirAttrs()
+}
+
+func (im *verImport) walkDir(src string) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+
+	dbBase, err := filepath.Abs(im.ver.db.base)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return im.skipVanished(err)
+		}
+
+		if name == dbBase {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+
+		attr, err := readAttr(name)
+		if err != nil {
+			return im.skipVanished(err)
+		}
+
+		entry := &importEntry{path: path.Clean("/" + filepath.ToSlash(rel)), attr: attr, size: info.Size(), source: name, backend: hostFS}
+		if entry.isSymlink() {
+			if entry.link, err = os.Readlink(name); err != nil {
+				return im.skipVanished(err)
+			}
+		} else if entry.xattrs, err = readXattrs(name); err != nil {
+			return im.skipVanished(err)
+		}
+
+		return im.importEntry(entry)
+	})
+}
+
+func (im *verImport) skipVanished(err error) error {
+	if im.Live && os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (im *verImport) walkTar(src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := &importEntry{
+			path: path.Clean("/" + hdr.Name),
+			attr: fileAttr{hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, hdr.ModTime, hdr.ModTime},
+			size: hdr.Size,
+			link: hdr.Linkname,
+		}
+
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.") {
+				if entry.xattrs == nil {
+					entry.xattrs = make(map[string]string)
+				}
+
+				entry.xattrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = value
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			if entry.source, err = im.resolveLink(path.Clean("/" + hdr.Linkname)); err != nil {
+				return err
+			}
+
+			entry.backend = im.ver.db.backend
+
+			info, err := entry.backend.Lstat(entry.source)
+			if err != nil {
+				return err
+			}
+
+			entry.attr.mode = info.Mode()
+			entry.size = info.Size()
+			entry.link = ""
+		case tar.TypeReg, tar.TypeRegA:
+			entry.reader = tr
+		}
+
+		if err := im.importEntry(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func (im *verImport) resolveLink(name string) (string, error) {
+	if err := im.checkParents(name); err != nil {
+		return "", err
+	}
+
+	if _, err := im.ver.db.backend.Lstat(im.ver.rebasePath(name)); err == nil {
+		return im.ver.rebasePath(name), nil
+	}
+
+	if im.head != nil {
+		if node := im.head.root.LookupNode(name); node != nil && node.flags&NodeFlagDir == 0 {
+			return node.rebasedPath(), nil
+		}
+	}
+
+	return "", fmt.Errorf("hard link target not found: %s", name)
+}
+
+func (im *verImport) lookupHead(name string) *Node {
+	if im.head == nil {
+		return nil
+	}
+
+	return im.head.root.LookupNode(name)
+}
+
+// checkParents refuses paths below anything but a real directory, since the
+// entry would otherwise be written through a symlink outside of the version.
+// Parents are looked up in the version being imported and, failing that, in
+// the head version.
+func (im *verImport) checkParents(name string) error {
+	backend := im.ver.db.backend
+
+	for _, dir := range parentPaths(name) {
+		info, err := backend.Lstat(im.ver.rebasePath(dir))
+		if os.IsNotExist(err) {
+			node := im.lookupHead(dir)
+			if node == nil || node.flags&NodeFlagDir != 0 {
+				continue
+			}
+
+			if info, err = backend.Lstat(node.rebasedPath()); err != nil {
+				return err
+			}
+
+			if info.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+		} else if err != nil {
+			return err
+		} else if info.IsDir() {
+			continue
+		}
+
+		return fmt.Errorf("%s: parent %s is not a directory", name, dir)
+	}
+
+	return nil
+}
+
+// forget drops what was seen below a path that an entry replaces.
+func (im *verImport) forget(name string) {
+	for seenPath := range im.seen {
+		if seenPath != name && isSubPath(seenPath, name) {
+			delete(im.seen, seenPath)
+			delete(im.seenDirs, seenPath)
+		}
+	}
+}
+
+func (im *verImport) importEntry(entry *importEntry) error {
+	if err := im.checkParents(entry.path); err != nil {
+		return err
+	}
+
+	im.seen[entry.path] = true
+	for _, dir := range parentPaths(entry.path) {
+		im.seen[dir] = true
+		im.seenDirs[dir] = true
+	}
+
+	backend := im.ver.db.backend
+	headNode := im.lookupHead(entry.path)
+
+	if entry.isDir() {
+		im.seenDirs[entry.path] = true
+		im.dirs[entry.path] = entry.attr
+
+		if entry.path == "/" {
+			return nil
+		}
+
+		// a directory replaces whatever an earlier entry left at its path
+		if info, err := backend.Lstat(im.ver.rebasePath(entry.path)); err == nil && !info.IsDir() {
+			if err := backend.Remove(im.ver.rebasePath(entry.path)); err != nil {
+				return err
+			}
+		}
+
+		same, err := im.sameNode(entry, headNode)
+		if err != nil || same {
+			return err
+		}
+
+		im.changed = true
+		return mkdirAll(backend, im.ver.rebasePath(entry.path), 0755)
+	}
+
+	if !entry.isSymlink() && !entry.attr.mode.IsRegular() {
+		return nil
+	}
+
+	if im.seenDirs[entry.path] {
+		delete(im.seenDirs, entry.path)
+		im.forget(entry.path)
+	}
+
+	same, err := im.sameNode(entry, headNode)
+	if err != nil || same {
+		return err
+	}
+
+	tempPath := path.Join(im.ver.dir, "import.tmp")
+	if err := im.writeEntry(entry, tempPath); err != nil {
+		backend.Remove(tempPath)
+		delete(im.seen, entry.path)
+		return im.skipVanished(err)
+	}
+
+	if headNode != nil && im.Hash && entry.reader != nil {
+		if same, err := im.sameAttr(entry, headNode); err != nil {
+			return err
+		} else if same {
+			same, err = sameContent(backend, tempPath, backend, headNode.rebasedPath())
+			if err != nil || same {
+				backend.Remove(tempPath)
+				return err
+			}
+		}
+	}
+
+	for _, dir := range parentPaths(entry.path) {
+		if err := mkdirAll(backend, im.ver.rebasePath(dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := backend.RemoveAll(im.ver.rebasePath(entry.path)); err != nil {
+		return err
+	}
+
+	im.changed = true
+	return backend.Rename(tempPath, im.ver.rebasePath(entry.path))
+}
+
+func (im *verImport) sameNode(entry *importEntry, headNode *Node) (bool, error) {
+	if headNode == nil {
+		return false, nil
+	}
+
+	if same, err := im.sameAttr(entry, headNode); err != nil || !same {
+		return false, err
+	}
+
+	switch {
+	case entry.isDir() || entry.isSymlink():
+		return true, nil
+	case !im.Hash:
+		attr, err := backendAttr(im.ver.db.backend, headNode.rebasedPath())
+		return sameTime(attr.mtime, entry.attr.mtime), err
+	case entry.source != "":
+		return sameContent(entry.backend, entry.source, im.ver.db.backend, headNode.rebasedPath())
+	}
+
+	// contents of streamed entries are compared once written
+	return false, nil
+}
+
+func (im *verImport) sameAttr(entry *importEntry, headNode *Node) (bool, error) {
+	backend := im.ver.db.backend
+
+	attr, err := backendAttr(backend, headNode.rebasedPath())
+	if err != nil {
+		return false, err
+	}
+
+	info, err := backend.Lstat(headNode.rebasedPath())
+	if err != nil {
+		return false, err
+	}
+
+	if attr.mode != entry.attr.mode {
+		return false, nil
+	}
+
+	if im.owners && (attr.uid != entry.attr.uid || attr.gid != entry.attr.gid) {
+		return false, nil
+	}
+
+	if entry.isSymlink() {
+		target, err := backend.Readlink(headNode.rebasedPath())
+		return target == entry.link, err
+	}
+
+	return entry.isDir() || info.Size() == entry.size, nil
+}
+
+// Attributes are applied before the file is closed, so that backends which
+// upload files when they are closed do so only once.
+func (im *verImport) writeEntry(entry *importEntry, dst string) error {
+	backend := im.ver.db.backend
+	if err := backend.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if entry.isSymlink() {
+		if err := backend.Symlink(entry.link, dst); err != nil {
+			return err
+		}
+
+		return entry.attr.apply(backend, dst)
+	}
+
+	file, err := backend.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := im.copyEntry(entry, file, dst); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (im *verImport) copyEntry(entry *importEntry, file BackendFile, dst string) error {
+	r := entry.reader
+	if r == nil {
+		src, err := entry.backend.Open(entry.source)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		r = src
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+
+	backend := im.ver.db.backend
+	if store, ok := backend.(xattrStore); ok {
+		if err := store.WriteXattrs(dst, entry.xattrs); err != nil {
+			return err
+		}
+	}
+
+	return entry.attr.apply(backend, dst)
+}
+
+func (im *verImport) removeMissing() error {
+	if im.head == nil {
+		return nil
+	}
+
+	// children of directories that were replaced by files are deleted as
+	// well, so that they do not reappear if the directory comes back
+	return im.head.root.Walk(func(node *Node) error {
+		if !im.seen[node.path] && im.seen[path.Dir(node.path)] {
+			if err := im.ver.meta.removeNode(node.path); err != nil {
+				return err
+			}
+
+			im.changed = true
+		}
+
+		return nil
+	})
+}
+
+func (im *verImport) applyDirAttrs() error {
+	backend := im.ver.db.backend
+
+	dirs := []string{"/"}
+	err := walkTree(backend, im.ver.rebasePath(), func(dir string, info os.FileInfo) error {
+		if info.IsDir() {
+			dirs = append(dirs, dir)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, dir := range dirs {
+		headNode := im.lookupHead(dir)
+
+		if attr, ok := im.dirs[dir]; ok {
+			if dir == "/" {
+				if same, err := im.sameNode(&importEntry{path: dir, attr: attr}, headNode); err != nil {
+					return err
+				} else if !same {
+					im.changed = true
+				}
+			}
+
+			if err := attr.apply(backend, im.ver.rebasePath(dir)); err != nil {
+				return err
+			}
+		} else if headNode != nil && headNode.flags&NodeFlagDir != 0 {
+			if err := copyAttr(backend, headNode.rebasedPath(), im.ver.rebasePath(dir)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func sameTime(a, b time.Time) bool {
+	if a.Nanosecond() == 0 || b.Nanosecond() == 0 {
+		return a.Unix() == b.Unix()
+	}
+
+	return a.Equal(b)
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hostTree describes a host directory the way readTree describes a version.
+func hostTree(t *testing.T, dir string) map[string]string {
+	tree := make(map[string]string)
+
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(filepath.Join("/", rel))
+		switch {
+		case info.IsDir():
+			tree[rel] = "dir"
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+
+			tree[rel] = "link:" + target
+		default:
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+
+			tree[rel] = "file:" + string(data)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+// hostFiles replaces the contents of a host directory, giving every file a
+// distinct modification time.
+func hostFiles(t *testing.T, dir string, step int, files map[string]string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range infos {
+		if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mtime := time.Date(2020, 1, step, 0, 0, 0, 0, time.UTC)
+	for name, data := range files {
+		hostPath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case data == "dir":
+			err = os.MkdirAll(hostPath, 0755)
+		case len(data) > 5 && data[:5] == "link:":
+			err = os.Symlink(data[5:], hostPath)
+		default:
+			if err = ioutil.WriteFile(hostPath, []byte(data), 0644); err == nil {
+				err = os.Chtimes(hostPath, mtime, mtime)
+			}
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeTar(t *testing.T, headers ...*tar.Header) string {
+	name := filepath.Join(tempDir(t), "import.tar")
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	for _, hdr := range headers {
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestImportSymlinkParent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		outside := tempDir(t)
+		if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unlock()
+
+		archives := map[string]string{
+			"symlink in archive": writeTar(t,
+				&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+				&tar.Header{Name: "a/victim", Typeflag: tar.TypeReg},
+			),
+			"hard link through symlink": writeTar(t,
+				&tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: outside},
+				&tar.Header{Name: "c", Typeflag: tar.TypeLink, Linkname: "b/secret"},
+			),
+		}
+
+		for label, archive := range archives {
+			if _, err := db.Import(archive, ImportOptions{}); err == nil {
+				t.Errorf("%s: import succeeded", label)
+			}
+		}
+
+		// symlinks already in the head version are not followed either
+		src := tempDir(t)
+		hostFiles(t, src, 1, map[string]string{"a": "link:" + outside})
+		if _, err := db.Import(src, ImportOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := writeTar(t, &tar.Header{Name: "a/victim", Typeflag: tar.TypeReg})
+		if _, err := db.Import(archive, ImportOptions{}); err == nil {
+			t.Error("import through a symlink in the head version succeeded")
+		}
+
+		compareTrees(t, "outside", map[string]string{"/": "dir", "/secret": "file:secret"}, hostTree(t, outside))
+	})
+}
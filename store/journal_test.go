@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a/f", "one")
+		writeFile(t, db, "/a/g", "two")
+		writeFile(t, db, "/b", "three")
+		unmount(t, db)
+
+		// the process dies without saving the metadata of its version
+		crashed := reopen(t, db)
+		mount(t, crashed)
+		removeAll(t, crashed, "/a/f")
+		removeAll(t, crashed, "/b")
+		mkdirs(t, crashed.Root(), "/c")
+		if err := crashed.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		head := crashed.Head()
+		journalPath := db.AreaPath("journals", head.Name())
+		metaPath := path.Join(head.dir, "meta.json")
+		expected := map[string]string{"/": "dir", "/a": "dir", "/a/g": "file:two", "/c": "dir"}
+
+		// readers replay the journal without touching the database
+		reader := reopen(t, db)
+		if err := reader.Load(0); err != nil {
+			t.Fatal(err)
+		}
+
+		compareTrees(t, "replayed", expected, readTree(t, reader.Root()))
+
+		if _, err := os.Stat(journalPath); err != nil {
+			t.Errorf("reader removed the journal: %v", err)
+		}
+
+		if _, err := db.backend.ReadMeta(metaPath); !os.IsNotExist(err) {
+			t.Errorf("reader wrote the metadata: %v", err)
+		}
+
+		// the next writer finalizes the crashed version
+		writer := reopen(t, db)
+		mount(t, writer)
+
+		if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+			t.Errorf("journal left behind: %v", err)
+		}
+
+		if _, err := db.backend.ReadMeta(metaPath); err != nil {
+			t.Errorf("metadata not written: %v", err)
+		}
+
+		// listing while the writer's head is still empty must not remove it
+		lister := reopen(t, db)
+		if err := lister.Load(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.backend.Stat(writer.Head().dir); err != nil {
+			t.Errorf("reader removed the writer's head: %v", err)
+		}
+
+		unmount(t, writer)
+
+		trees := readVersions(t, db)
+		if len(trees) != 2 {
+			t.Fatalf("found %d versions", len(trees))
+		}
+
+		compareTrees(t, "finalized", expected, trees[1])
+	})
+}
+
+// Metadata is saved by autosaves and checkpoints while the mount keeps
+// changing it.
+func TestJournalConcurrentSave(t *testing.T) {
+	state := tempDir(t)
+	backend := NewMemoryBackend()
+	journalPath := path.Join(state, "journal")
+
+	meta, err := newVerMeta(backend, "meta.json", journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 1000
+	done := make(chan error)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := meta.setSum(fmt.Sprintf("/f%d", i), "sum"); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			running = false
+		default:
+		}
+
+		if err := meta.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+
+	saved, err := newVerMeta(backend, "meta.json", journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved.sums) != count {
+		t.Errorf("expected %d checksums, got %d", count, len(saved.sums))
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//
+//	Database
+//
+
+func (db *Database) lockPath() string {
+	return db.AreaPath("lock")
+}
+
+// Lock takes the exclusive lock held by writable mounts and subcommands that
+// modify the database, stamps or checks the database format and completes or
+// rolls back interrupted squashes. Readers do not lock, so they never block
+// a writer.
+func (db *Database) Lock() error {
+	if err := db.acquireLock(); err != nil {
+		return err
+	}
+
+	if err := db.writeFormat(); err != nil {
+		db.Unlock()
+		return err
+	}
+
+	if err := db.recoverSquash(); err != nil {
+		db.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (db *Database) acquireLock() error {
+	if shared, ok := db.backend.(sharedBackend); ok && !shared.Exclusive() {
+		return errors.New("the database lock cannot keep other hosts from writing to this backend; " +
+			"enable the exclusive setting once only one host writes to it")
+	}
+
+	if err := os.MkdirAll(db.AreaPath(), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(db.lockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return db.lockError()
+		}
+
+		return err
+	}
+
+	if pid := db.lockPid(); pid != 0 && pid != os.Getpid() {
+		log.Printf("removing stale lock left by process %d", pid)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return err
+	}
+
+	if _, err := file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		file.Close()
+		return err
+	}
+
+	db.lockFile = file
+	return nil
+}
+
+func (db *Database) Unlock() error {
+	if db.lockFile == nil {
+		return nil
+	}
+
+	db.lockFile.Truncate(0)
+	err := db.lockFile.Close()
+	db.lockFile = nil
+	return err
+}
+
+func (db *Database) lockPid() int {
+	data, err := ioutil.ReadFile(db.lockPath())
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
+
+func (db *Database) lockError() error {
+	if pid := db.lockPid(); pid != 0 && processAlive(pid) {
+		return fmt.Errorf("database is locked by process %d", pid)
+	}
+
+	return errors.New("database is locked by another process")
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	state := tempDir(t)
+
+	writer, err := Open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount(t, writer)
+	writeFile(t, writer, "/f", "hello")
+
+	other, err := Open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.Lock()
+	if err == nil {
+		t.Fatal("second writer took the lock")
+	}
+
+	if !strings.Contains(err.Error(), "locked by process") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// readers do not lock and leave the writer's head alone
+	reader, err := Open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reader.Load(0); err != nil {
+		t.Fatal(err)
+	}
+
+	unmount(t, writer)
+
+	if err := other.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockShared(t *testing.T) {
+	config := newS3Config(t)
+	config.Exclusive = false
+
+	state := tempDir(t)
+	writeS3Config(t, state, config)
+
+	db, err := Open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Lock(); err == nil {
+		t.Fatal("locked a shared backend that was not vouched for")
+	}
+
+	if err := db.Migrate(false, ioutil.Discard); err == nil {
+		t.Error("migrated a shared backend that was not vouched for")
+	}
+
+	// readers need no lock
+	if err := db.Load(0); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Exclusive = true
+	writeS3Config(t, state, config)
+
+	if db, err = Open(state); err != nil {
+		t.Fatal(err)
+	}
+
+	mount(t, db)
+	writeFile(t, db, "/f", "hello")
+	unmount(t, db)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"path"
+	"sort"
+	"time"
+)
+
+//
+//	LogEntry
+//
+
+type LogEntry struct {
+	Index     int
+	Timestamp time.Time
+	Tag       string
+	Message   string
+	Created   int
+	Modified  int
+	Deleted   int
+	Bytes     int64
+	Changes   []Change
+}
+
+func (db *Database) logVer(index int, prev *Dir) (*LogEntry, *Dir, error) {
+	ver := db.vers[index]
+
+	root, err := ver.build()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log := &LogEntry{Index: index + 1, Timestamp: ver.timestamp, Tag: ver.meta.tag, Message: ver.meta.message}
+
+	deleted := make(map[string]bool)
+	for path, del := range ver.meta.deleted {
+		if del {
+			deleted[path] = true
+		}
+	}
+
+	err = root.Walk(func(node *Node) error {
+		_, isRef := ver.meta.refs[node.path]
+		if node.path == "/" || (node.ver != ver && !isRef) {
+			return nil
+		}
+
+		isDir := node.flags&NodeFlagDir == NodeFlagDir
+
+		var prevNode *Node
+		if prev != nil {
+			prevNode = prev.LookupNode(node.path)
+		}
+
+		// a directory replaced by a file takes its entries with it
+		switch {
+		case prevNode == nil:
+			log.Created++
+			log.Changes = append(log.Changes, Change{Path: node.path, Change: "created", Dir: isDir})
+		case prevNode.flags&NodeFlagDir != node.flags&NodeFlagDir:
+			log.Modified++
+			log.Changes = append(log.Changes, Change{Path: node.path, Change: "modified", Dir: isDir})
+
+			if prevDir := prev.Lookup(node.path); prevDir != nil {
+				for _, entry := range prevDir.Entries() {
+					if entry.Name != "." && entry.Name != ".." {
+						deleted[path.Join(node.path, entry.Name)] = true
+					}
+				}
+			}
+		case !isDir:
+			log.Modified++
+			log.Changes = append(log.Changes, Change{Path: node.path, Change: "modified"})
+		}
+
+		if isDir || node.ver != ver {
+			return nil
+		}
+
+		info, err := node.ver.db.backend.Lstat(node.rebasedPath())
+		if err != nil {
+			return err
+		}
+
+		log.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var paths []string
+	for path := range deleted {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		log.Deleted++
+		log.Changes = append(log.Changes, Change{Path: path, Change: "deleted"})
+	}
+
+	return log, root, nil
+}
+
+// Log calls fn with a summary of each version, oldest first.
+func (db *Database) Log(fn func(entry *LogEntry) error) error {
+	var prev *Dir
+	for index := range db.vers {
+		var entry *LogEntry
+		var err error
+		if entry, prev, err = db.logVer(index, prev); err != nil {
+			return err
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/d/x", "one")
+		writeFile(t, db, "/d/y", "two")
+		writeFile(t, db, "/f", "three")
+		unmount(t, db)
+
+		// the directory turns into a file
+		mount(t, db)
+		removeAll(t, db, "/d")
+		writeFile(t, db, "/d", "four")
+		writeFile(t, db, "/f", "five!")
+		unmount(t, db)
+
+		mount(t, db)
+		removeAll(t, db, "/f")
+		unmount(t, db)
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		var entries []*LogEntry
+		err := db.Log(func(entry *LogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []struct {
+			created, modified, deleted int
+			bytes                      int64
+			changes                    []Change
+		}{
+			{4, 0, 0, 11, []Change{
+				{Path: "/d", Change: "created", Dir: true},
+				{Path: "/d/x", Change: "created"},
+				{Path: "/d/y", Change: "created"},
+				{Path: "/f", Change: "created"},
+			}},
+			{0, 2, 2, 9, []Change{
+				{Path: "/d", Change: "modified"},
+				{Path: "/f", Change: "modified"},
+				{Path: "/d/x", Change: "deleted"},
+				{Path: "/d/y", Change: "deleted"},
+			}},
+			{0, 0, 1, 0, []Change{
+				{Path: "/f", Change: "deleted"},
+			}},
+		}
+
+		if len(entries) != len(expected) {
+			t.Fatalf("%d log entries", len(entries))
+		}
+
+		for i, entry := range entries {
+			e := expected[i]
+			if entry.Created != e.created || entry.Modified != e.modified || entry.Deleted != e.deleted || entry.Bytes != e.bytes {
+				t.Errorf("version %d: %d created, %d modified, %d deleted, %d bytes", entry.Index, entry.Created, entry.Modified, entry.Deleted, entry.Bytes)
+			}
+
+			if !reflect.DeepEqual(entry.Changes, e.changes) {
+				t.Errorf("version %d: changes %+v", entry.Index, entry.Changes)
+			}
+		}
+	})
+}
@@ -0,0 +1,547 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+//	memBackend
+//
+
+type memEntry struct {
+	mode  os.FileMode
+	uid   int
+	gid   int
+	atime time.Time
+	mtime time.Time
+	ctime time.Time
+	data  []byte
+	link  string
+}
+
+type memBackend struct {
+	entries map[string]*memEntry
+	metas   map[string][]byte
+	mutex   sync.Mutex
+}
+
+// NewMemoryBackend returns a backend that keeps versions in memory, which is
+// mostly useful for tests.
+func NewMemoryBackend() Backend {
+	now := time.Now()
+	root := &memEntry{mode: os.ModeDir | 0755, uid: os.Geteuid(), gid: os.Getegid(), atime: now, mtime: now, ctime: now}
+
+	return &memBackend{entries: map[string]*memEntry{"/": root}, metas: make(map[string][]byte)}
+}
+
+func memName(name string) string {
+	return path.Join("/", name)
+}
+
+func (b *memBackend) lookup(op, name string) (*memEntry, error) {
+	entry, ok := b.entries[memName(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+
+	return entry, nil
+}
+
+func (b *memBackend) parent(op, name string) error {
+	parent, err := b.lookup(op, path.Dir(memName(name)))
+	if err != nil {
+		return err
+	}
+
+	if !parent.mode.IsDir() {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+
+	return nil
+}
+
+func (b *memBackend) create(name string, mode os.FileMode) *memEntry {
+	now := time.Now()
+	entry := &memEntry{mode: mode, uid: os.Geteuid(), gid: os.Getegid(), atime: now, mtime: now, ctime: now}
+	b.entries[memName(name)] = entry
+
+	return entry
+}
+
+func (b *memBackend) Stat(name string) (os.FileInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i := 0; i < 40; i++ {
+		entry, err := b.lookup("stat", name)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.mode&os.ModeSymlink == 0 {
+			return entry.info(path.Base(memName(name))), nil
+		}
+
+		if strings.HasPrefix(entry.link, "/") {
+			name = entry.link
+		} else {
+			name = path.Join(path.Dir(memName(name)), entry.link)
+		}
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ELOOP}
+}
+
+func (b *memBackend) Lstat(name string) (os.FileInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.info(path.Base(memName(name))), nil
+}
+
+func (b *memBackend) Readlink(name string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	if entry.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+
+	return entry.link, nil
+}
+
+func (b *memBackend) List(name string) ([]os.FileInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	dir := memName(name)
+
+	var infos []os.FileInfo
+	for childName, child := range b.entries {
+		if childName != dir && path.Dir(childName) == dir {
+			infos = append(infos, child.info(path.Base(childName)))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (b *memBackend) Open(name string) (BackendFile, error) {
+	return b.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (b *memBackend) OpenFile(name string, flags int, mode os.FileMode) (BackendFile, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("open", name)
+	switch {
+	case err == nil && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case err == nil && entry.mode.IsDir() && flags&syscall.O_ACCMODE != os.O_RDONLY:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case os.IsNotExist(err) && flags&os.O_CREATE != 0:
+		if err := b.parent("open", name); err != nil {
+			return nil, err
+		}
+
+		entry = b.create(name, mode.Perm())
+	case err != nil:
+		return nil, err
+	}
+
+	if flags&os.O_TRUNC != 0 && flags&syscall.O_ACCMODE != os.O_RDONLY {
+		entry.data = nil
+		entry.mtime = time.Now()
+	}
+
+	return &memFile{b, entry, name, flags, 0}, nil
+}
+
+func (b *memBackend) Mkdir(name string, mode os.FileMode) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := b.lookup("mkdir", name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	if err := b.parent("mkdir", name); err != nil {
+		return err
+	}
+
+	b.create(name, os.ModeDir|mode.Perm())
+	return nil
+}
+
+func (b *memBackend) Symlink(target, name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := b.lookup("symlink", name); err == nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	}
+
+	if err := b.parent("symlink", name); err != nil {
+		return err
+	}
+
+	b.create(name, os.ModeSymlink|0777).link = target
+	return nil
+}
+
+func (b *memBackend) Rename(oldname, newname string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("rename", oldname)
+	if err != nil {
+		return err
+	}
+
+	if err := b.parent("rename", newname); err != nil {
+		return err
+	}
+
+	oldname, newname = memName(oldname), memName(newname)
+	if isSubPath(newname, oldname) {
+		if newname == oldname {
+			return nil
+		}
+
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+
+	if existing, ok := b.entries[newname]; ok {
+		if existing.mode.IsDir() != entry.mode.IsDir() {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EEXIST}
+		}
+
+		for childName := range b.entries {
+			if childName != newname && isSubPath(childName, newname) {
+				return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+
+	for metaName := range b.metas {
+		if isSubPath(metaName, newname) {
+			delete(b.metas, metaName)
+		}
+	}
+
+	entries := make(map[string]*memEntry)
+	for childName, child := range b.entries {
+		if isSubPath(childName, oldname) {
+			entries[newname+strings.TrimPrefix(childName, oldname)] = child
+			delete(b.entries, childName)
+		}
+	}
+
+	metas := make(map[string][]byte)
+	for metaName, data := range b.metas {
+		if isSubPath(metaName, oldname) {
+			metas[newname+strings.TrimPrefix(metaName, oldname)] = data
+			delete(b.metas, metaName)
+		}
+	}
+
+	for childName, child := range entries {
+		b.entries[childName] = child
+	}
+
+	for metaName, data := range metas {
+		b.metas[metaName] = data
+	}
+
+	return nil
+}
+
+// Link copies an entry with its attributes; versions never write to files they
+// share, so a copy behaves like a hard link.
+func (b *memBackend) Link(oldname, newname string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+
+	if entry.mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	if _, err := b.lookup("link", newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+
+	if err := b.parent("link", newname); err != nil {
+		return err
+	}
+
+	link := *entry
+	link.data = append([]byte(nil), entry.data...)
+	b.entries[memName(newname)] = &link
+
+	return nil
+}
+
+func (b *memBackend) Remove(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+
+	if entry.mode.IsDir() {
+		prefix := memName(name) + "/"
+		for childName := range b.entries {
+			if strings.HasPrefix(childName, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+
+	delete(b.entries, memName(name))
+	return nil
+}
+
+func (b *memBackend) RemoveAll(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	name = memName(name)
+	for childName := range b.entries {
+		if childName != "/" && isSubPath(childName, name) {
+			delete(b.entries, childName)
+		}
+	}
+
+	for metaName := range b.metas {
+		if isSubPath(metaName, name) {
+			delete(b.metas, metaName)
+		}
+	}
+
+	return nil
+}
+
+func (b *memBackend) Chmod(name string, mode os.FileMode) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+
+	entry.mode = entry.mode&os.ModeType | mode.Perm()
+	entry.ctime = time.Now()
+	return nil
+}
+
+func (b *memBackend) Chown(name string, uid, gid int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("chown", name)
+	if err != nil {
+		return err
+	}
+
+	if uid >= 0 {
+		entry.uid = uid
+	}
+	if gid >= 0 {
+		entry.gid = gid
+	}
+
+	entry.ctime = time.Now()
+	return nil
+}
+
+func (b *memBackend) Chtimes(name string, atime, mtime time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, err := b.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+
+	entry.atime = atime
+	entry.mtime = mtime
+	entry.ctime = time.Now()
+	return nil
+}
+
+func (b *memBackend) ReadMeta(name string) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	data, ok := b.metas[memName(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+func (b *memBackend) WriteMeta(name string, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.parent("open", name); err != nil {
+		return err
+	}
+
+	b.metas[memName(name)] = append([]byte(nil), data...)
+	return nil
+}
+
+//
+//	memEntry
+//
+
+func (e *memEntry) info(name string) os.FileInfo {
+	size := int64(len(e.data))
+	if e.mode&os.ModeSymlink != 0 {
+		size = int64(len(e.link))
+	}
+
+	return newAttrInfo(name, fileAttr{e.mode, e.uid, e.gid, e.atime, e.mtime}, size, e.ctime)
+}
+
+//
+//	memFile
+//
+
+type memFile struct {
+	backend *memBackend
+	entry   *memEntry
+	name    string
+	flags   int
+	offset  int64
+}
+
+func (f *memFile) Read(data []byte) (int, error) {
+	size, err := f.ReadAt(data, f.offset)
+	f.offset += int64(size)
+	if err == io.EOF && size > 0 {
+		err = nil
+	}
+
+	return size, err
+}
+
+func (f *memFile) ReadAt(data []byte, offset int64) (int, error) {
+	f.backend.mutex.Lock()
+	defer f.backend.mutex.Unlock()
+
+	if f.flags&syscall.O_ACCMODE == os.O_WRONLY {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+
+	if offset >= int64(len(f.entry.data)) {
+		return 0, io.EOF
+	}
+
+	size := copy(data, f.entry.data[offset:])
+	if size < len(data) {
+		return size, io.EOF
+	}
+
+	return size, nil
+}
+
+func (f *memFile) Write(data []byte) (int, error) {
+	if f.flags&os.O_APPEND != 0 {
+		f.backend.mutex.Lock()
+		f.offset = int64(len(f.entry.data))
+		f.backend.mutex.Unlock()
+	}
+
+	size, err := f.WriteAt(data, f.offset)
+	f.offset += int64(size)
+	return size, err
+}
+
+func (f *memFile) WriteAt(data []byte, offset int64) (int, error) {
+	f.backend.mutex.Lock()
+	defer f.backend.mutex.Unlock()
+
+	if f.flags&syscall.O_ACCMODE == os.O_RDONLY {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+
+	if end := offset + int64(len(data)); end > int64(len(f.entry.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.entry.data)
+		f.entry.data = grown
+	}
+
+	copy(f.entry.data[offset:], data)
+	f.entry.mtime = time.Now()
+
+	return len(data), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
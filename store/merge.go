@@ -0,0 +1,678 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+//	verPlan
+//
+
+type planNode struct {
+	path string
+	ver  *Version
+	dir  bool
+}
+
+type planRef struct {
+	path  string
+	ver   *Version
+	owner *Version
+}
+
+type verPlan struct {
+	db      *Database
+	parent  *Version
+	tree    *Dir
+	vers    verList
+	nodes   []planNode
+	refs    []planNode
+	deleted []string
+}
+
+func (db *Database) planVer(parent *Version, tree *Dir, vers verList) (*verPlan, error) {
+	plan := &verPlan{db: db, parent: parent, tree: tree, vers: vers}
+	if err := plan.build(tree); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (p *verPlan) moved(ver *Version) bool {
+	for _, v := range p.vers {
+		if v == ver {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *verPlan) build(dir *Dir) error {
+	var baseNodes verNodeMap
+	if p.parent != nil {
+		var err error
+		if baseNodes, err = p.parent.scanDir(dir.node.path); err != nil {
+			return err
+		}
+	}
+
+	var baseNames []string
+	for name := range baseNodes {
+		baseNames = append(baseNames, name)
+	}
+	sort.Strings(baseNames)
+
+	for _, name := range baseNames {
+		if !dir.has(name) {
+			p.deleted = append(p.deleted, baseNodes[name].path)
+		}
+	}
+
+	for _, name := range dir.names() {
+		subDir, isDir := dir.dirs[name]
+
+		var node *Node
+		if isDir {
+			node = subDir.node
+		} else {
+			node = dir.files[name].node
+		}
+
+		if p.moved(node.ver) {
+			p.nodes = append(p.nodes, planNode{node.path, node.ver, isDir})
+		} else if baseNode, ok := baseNodes[name]; !ok || baseNode.ver != node.ver || baseNode.flags&NodeFlagDir != node.flags&NodeFlagDir {
+			p.refs = append(p.refs, planNode{node.path, node.ver, isDir})
+		}
+
+		if isDir {
+			if err := p.build(subDir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *verPlan) stage(dir string, timestamp time.Time) (*Version, error) {
+	ver, err := newVer(dir, timestamp, p.db)
+	if err != nil {
+		return nil, err
+	}
+
+	ver.parent = p.parent
+	backend := p.db.backend
+
+	if err := mkdirAll(backend, ver.rebasePath(), 0755); err != nil {
+		return nil, err
+	}
+
+	var dirs []planNode
+	for _, node := range p.nodes {
+		if node.dir {
+			if err := mkdirAll(backend, ver.rebasePath(node.path), 0755); err != nil {
+				return nil, err
+			}
+
+			dirs = append(dirs, node)
+		} else {
+			if err := linkFile(backend, node.ver.rebasePath(node.path), ver.rebasePath(node.path)); err != nil {
+				return nil, err
+			}
+
+			if sum, ok := node.ver.meta.sum(node.path); ok {
+				if err := ver.meta.setSum(node.path, sum); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyAttr(backend, dirs[i].ver.rebasePath(dirs[i].path), ver.rebasePath(dirs[i].path)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := copyAttr(backend, p.tree.node.rebasedPath(), ver.rebasePath()); err != nil {
+		return nil, err
+	}
+
+	for _, node := range p.refs {
+		if err := ver.meta.refNode(node.path, node.ver.name()); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range p.deleted {
+		if err := ver.meta.removeNode(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return ver, nil
+}
+
+func (p *verPlan) verify(ver *Version) error {
+	if err := ver.resolve(); err != nil {
+		return err
+	}
+
+	expected, err := buildTreeSig(p.tree)
+	if err != nil {
+		return err
+	}
+
+	actual, err := buildTreeSig(ver.root)
+	if err != nil {
+		return err
+	}
+
+	if paths := expected.diff(actual); len(paths) > 0 {
+		return fmt.Errorf("version does not resolve identically: %s", strings.Join(paths, ", "))
+	}
+
+	return nil
+}
+
+//
+//	squashPlan
+//
+
+type squashPlan struct {
+	*verPlan
+	target    *Version
+	rewrites  []planRef
+	materials []planRef
+}
+
+func (db *Database) planSquash(first, last int) (*squashPlan, error) {
+	if first < 0 || first > last || last >= len(db.vers) {
+		return nil, errors.New("invalid version range")
+	}
+
+	target := db.vers[last]
+	if err := target.resolve(); err != nil {
+		return nil, err
+	}
+
+	plan, err := db.planVer(db.vers[first].parent, target.root, db.vers[first:last+1])
+	if err != nil {
+		return nil, err
+	}
+
+	squash := &squashPlan{verPlan: plan, target: target}
+	for _, ver := range db.vers[last+1:] {
+		if err := squash.planRefs(ver); err != nil {
+			return nil, err
+		}
+	}
+
+	return squash, nil
+}
+
+func (p *squashPlan) planRefs(ver *Version) error {
+	var paths []string
+	for path := range ver.meta.refs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		var owner *Version
+		for _, v := range p.vers[:len(p.vers)-1] {
+			if v.name() == ver.meta.refs[path] {
+				owner = v
+			}
+		}
+
+		if owner == nil {
+			continue
+		}
+
+		ref := planRef{path, ver, owner}
+		if node := p.target.root.LookupNode(path); node != nil && node.ver == owner {
+			p.rewrites = append(p.rewrites, ref)
+		} else {
+			if ver.root == nil {
+				if err := ver.resolve(); err != nil {
+					return err
+				}
+			}
+
+			p.materials = append(p.materials, ref)
+		}
+	}
+
+	return nil
+}
+
+func (p *squashPlan) materialize(ref planRef) error {
+	backend := p.db.backend
+
+	for _, dir := range parentPaths(ref.path) {
+		if _, err := backend.Lstat(ref.ver.rebasePath(dir)); os.IsNotExist(err) {
+			if err := backend.Mkdir(ref.ver.rebasePath(dir), 0755); err != nil {
+				return err
+			}
+		}
+	}
+
+	src := ref.owner.rebasePath(ref.path)
+	dst := ref.ver.rebasePath(ref.path)
+
+	info, err := backend.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if err := mkdirAll(backend, dst, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := backend.RemoveAll(dst); err != nil {
+			return err
+		}
+
+		if err := linkFile(backend, src, dst); err != nil {
+			return err
+		}
+
+		if sum, ok := ref.owner.meta.sum(ref.path); ok {
+			if err := ref.ver.meta.setSum(ref.path, sum); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ref.ver.meta.unrefNode(ref.path)
+}
+
+func (p *squashPlan) materializeAll() error {
+	type dirAttr struct {
+		ver  *Version
+		path string
+		attr fileAttr
+	}
+
+	var attrs []dirAttr
+	for _, ref := range p.materials {
+		paths := append([]string{"/"}, parentPaths(ref.path)...)
+		paths = append(paths, ref.path)
+
+		for _, path := range paths {
+			node := ref.ver.root.LookupNode(path)
+			if node == nil || node.flags&NodeFlagDir == 0 {
+				continue
+			}
+
+			attr, err := backendAttr(p.db.backend, node.rebasedPath())
+			if err != nil {
+				return err
+			}
+
+			attrs = append(attrs, dirAttr{ref.ver, path, attr})
+		}
+	}
+
+	for _, ref := range p.materials {
+		if err := p.materialize(ref); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].path > attrs[j].path })
+	for _, da := range attrs {
+		if err := da.attr.apply(p.db.backend, da.ver.rebasePath(da.path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply rebuilds the target version in the stage area and then swaps it in
+// following a marker that records the progress of the swap, so that a squash
+// interrupted after it was committed is rolled forward when the database is
+// next locked.
+func (p *squashPlan) apply() error {
+	backend := p.db.backend
+	if err := mkdirAll(backend, stagePath(), 0755); err != nil {
+		return err
+	}
+
+	name := p.target.name()
+	for _, stale := range []string{name + ".squash", name + ".prev"} {
+		if err := backend.RemoveAll(stagePath(stale)); err != nil {
+			return err
+		}
+	}
+
+	ver, err := p.stage(stagePath(name+".squash"), p.target.timestamp)
+	if err != nil {
+		return err
+	}
+
+	if err := ver.meta.setTag(p.target.meta.tag, p.target.meta.message); err != nil {
+		return err
+	}
+
+	if err := ver.updateSums(); err != nil {
+		return err
+	}
+
+	if err := ver.meta.save(); err != nil {
+		return err
+	}
+
+	if err := p.verify(ver); err != nil {
+		backend.RemoveAll(ver.dir)
+		return err
+	}
+
+	// materialized files are copies, so they are harmless if the squash
+	// does not complete
+	if err := p.materializeAll(); err != nil {
+		return err
+	}
+
+	for _, ref := range p.materials {
+		if err := ref.ver.updateSums(); err != nil {
+			return err
+		}
+
+		if err := ref.ver.meta.save(); err != nil {
+			return err
+		}
+	}
+
+	marker := &squashMarker{Phase: "prev", Target: name}
+	for _, ref := range p.rewrites {
+		marker.Rewrites = append(marker.Rewrites, squashRewrite{ref.ver.name(), ref.path})
+	}
+	for _, v := range p.vers[:len(p.vers)-1] {
+		marker.Remove = append(marker.Remove, v.name())
+	}
+
+	if err := marker.save(p.db); err != nil {
+		return err
+	}
+
+	return marker.finish(p.db)
+}
+
+//
+//	squashMarker
+//
+
+type squashRewrite struct {
+	Ver  string `json:"ver"`
+	Path string `json:"path"`
+}
+
+type squashMarker struct {
+	Phase    string          `json:"phase"`
+	Target   string          `json:"target"`
+	Rewrites []squashRewrite `json:"rewrites,omitempty"`
+	Remove   []string        `json:"remove,omitempty"`
+}
+
+func (m *squashMarker) path() string {
+	return stagePath(m.Target + ".json")
+}
+
+func (m *squashMarker) save(db *Database) error {
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return db.backend.WriteMeta(m.path(), js)
+}
+
+// finish completes the swap, or the rollback of an older squash, from the
+// recorded phase; every step may be repeated after a crash.
+func (m *squashMarker) finish(db *Database) error {
+	backend := db.backend
+	stage := stagePath(m.Target + ".squash")
+	prev := stagePath(m.Target + ".prev")
+
+	if m.Phase == "undo" {
+		if err := backend.RemoveAll(m.Target); err != nil {
+			return err
+		}
+
+		m.Phase = "restore"
+		if err := m.save(db); err != nil {
+			return err
+		}
+	}
+
+	if m.Phase == "restore" {
+		if err := renameIfExists(backend, prev, m.Target); err != nil {
+			return err
+		}
+
+		if err := db.repairRefs(m.Target); err != nil {
+			return err
+		}
+
+		if err := backend.RemoveAll(stage); err != nil {
+			return err
+		}
+
+		return backend.RemoveAll(m.path())
+	}
+
+	if m.Phase == "prev" {
+		if err := renameIfExists(backend, m.Target, prev); err != nil {
+			return err
+		}
+
+		m.Phase = "swap"
+		if err := m.save(db); err != nil {
+			return err
+		}
+	}
+
+	if m.Phase == "swap" {
+		if err := renameIfExists(backend, stage, m.Target); err != nil {
+			return err
+		}
+
+		m.Phase = "rewrite"
+		if err := m.save(db); err != nil {
+			return err
+		}
+	}
+
+	for _, rewrite := range m.Rewrites {
+		if err := db.rewriteRef(rewrite.Ver, rewrite.Path, m.Target); err != nil {
+			return err
+		}
+	}
+
+	// once the previous target is gone, only the marker is left to remove
+	for _, name := range append(m.Remove, prev) {
+		if err := backend.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+
+	return backend.RemoveAll(m.path())
+}
+
+func renameIfExists(b Backend, oldname, newname string) error {
+	if _, err := b.Lstat(oldname); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return b.Rename(oldname, newname)
+}
+
+//
+//	Database
+//
+
+// rewriteRef points a reference of a version at another version.
+func (db *Database) rewriteRef(name, refPath, target string) error {
+	meta, err := newVerMeta(db.backend, path.Join(name, "meta.json"), db.AreaPath("journals", name))
+	if err != nil {
+		return err
+	}
+
+	if meta.refs[refPath] != target {
+		if err := meta.refNode(refPath, target); err != nil {
+			return err
+		}
+	}
+
+	return meta.save()
+}
+
+// recoverSquash completes squashes that were interrupted after their swap
+// was committed and rolls back the others, including those left behind by
+// older releases, which rewrote references before swapping.
+func (db *Database) recoverSquash() error {
+	infos, err := db.backend.List(stagePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// entries not named after a version are not ours to touch
+	pending := make(map[string]bool)
+	for _, info := range infos {
+		switch ext := path.Ext(info.Name()); ext {
+		case ".json", ".squash", ".prev":
+			if name := strings.TrimSuffix(info.Name(), ext); isVerName(name) {
+				pending[name] = true
+			}
+		}
+	}
+
+	var names []string
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := db.backend.ReadMeta(stagePath(name + ".json"))
+		if os.IsNotExist(err) {
+			if err := db.rollbackSquash(name); err != nil {
+				return err
+			}
+
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var marker squashMarker
+		if err := json.Unmarshal(data, &marker); err != nil {
+			return fmt.Errorf("invalid squash marker for %s: %s", name, err)
+		}
+
+		if err := marker.finish(db); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *Database) rollbackSquash(name string) error {
+	if _, err := db.backend.Lstat(stagePath(name + ".prev")); os.IsNotExist(err) {
+		return db.backend.RemoveAll(stagePath(name + ".squash"))
+	} else if err != nil {
+		return err
+	}
+
+	marker := &squashMarker{Phase: "undo", Target: name}
+	if err := marker.save(db); err != nil {
+		return err
+	}
+
+	return marker.finish(db)
+}
+
+// repairRefs points references to data that the restored version only
+// inherits back at the version holding it.
+func (db *Database) repairRefs(name string) error {
+	vers, err := db.loadVers()
+	if err != nil {
+		return err
+	}
+
+	for i, target := range vers {
+		if target.name() != name {
+			continue
+		}
+
+		if err := target.resolve(); err != nil {
+			return err
+		}
+
+		for _, ver := range vers[i+1:] {
+			for refPath, refName := range ver.meta.refs {
+				if refName != name {
+					continue
+				}
+
+				if _, err := db.backend.Lstat(target.rebasePath(refPath)); err == nil {
+					continue
+				}
+
+				if node := target.root.LookupNode(refPath); node != nil {
+					if err := db.rewriteRef(ver.name(), refPath, node.ver.name()); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// stagePath returns the backend name of the area where versions are rebuilt
+// before they replace the originals.
+func stagePath(names ...string) string {
+	return path.Join(append([]string{".vfs", "stage"}, names...)...)
+}
@@ -0,0 +1,395 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+)
+
+//
+//	verMeta
+//
+
+type verFmt struct {
+	Deleted []string          `json:"deleted"`
+	Refs    map[string]string `json:"refs,omitempty"`
+	Sums    map[string]string `json:"sums,omitempty"`
+	Tag     string            `json:"tag,omitempty"`
+	Message string            `json:"message,omitempty"`
+}
+
+type verMeta struct {
+	backend     Backend
+	path        string
+	journalPath string
+	deleted     map[string]bool
+	refs        map[string]string
+	sums        map[string]string
+	tag         string
+	message     string
+	modified    bool
+	journal     *os.File
+	mutex       sync.Mutex
+}
+
+type journalEntry struct {
+	Op      string `json:"op"`
+	Path    string `json:"path,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Metadata is read and written through the backend; the journal is runtime
+// state and always stays on the host.
+func newVerMeta(backend Backend, path, journalPath string) (*verMeta, error) {
+	meta := &verMeta{backend: backend, path: path, journalPath: journalPath, deleted: make(map[string]bool), refs: make(map[string]string), sums: make(map[string]string)}
+	if err := meta.load(); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (m *verMeta) filter(nodes verNodeMap) {
+	for path, deleted := range m.deleted {
+		if !deleted {
+			continue
+		}
+
+		for name, node := range nodes {
+			if isSubPath(node.path, path) {
+				delete(nodes, name)
+			}
+		}
+	}
+}
+
+func (m *verMeta) removeNode(path string) error {
+	return m.change(journalEntry{Op: "remove", Path: path})
+}
+
+func (m *verMeta) undeleteNode(path string) error {
+	return m.change(journalEntry{Op: "undelete", Path: path})
+}
+
+func (m *verMeta) createNode(path string) error {
+	return m.change(journalEntry{Op: "create", Path: path})
+}
+
+// modifyNode marks the version as modified; only the checksums and the
+// reference it drops need to be journaled.
+func (m *verMeta) modifyNode(path string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.modified = true
+	if _, ok := m.refs[path]; ok {
+		return m.changeLocked(journalEntry{Op: "modify", Path: path})
+	}
+
+	for sumPath := range m.sums {
+		if isSubPath(sumPath, path) {
+			return m.changeLocked(journalEntry{Op: "modify", Path: path})
+		}
+	}
+
+	return nil
+}
+
+func (m *verMeta) clearSums(path string) {
+	for sumPath := range m.sums {
+		if isSubPath(sumPath, path) {
+			delete(m.sums, sumPath)
+		}
+	}
+}
+
+func (m *verMeta) setSum(path, sum string) error {
+	return m.change(journalEntry{Op: "sum", Path: path, Name: sum})
+}
+
+func (m *verMeta) unsetSum(path string) error {
+	return m.change(journalEntry{Op: "unsum", Path: path})
+}
+
+func (m *verMeta) sum(path string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sum, ok := m.sums[path]
+	return sum, ok
+}
+
+func (m *verMeta) refNode(path, name string) error {
+	return m.change(journalEntry{Op: "ref", Path: path, Name: name})
+}
+
+func (m *verMeta) unrefNode(path string) error {
+	return m.change(journalEntry{Op: "unref", Path: path})
+}
+
+func (m *verMeta) clearNode(path string) error {
+	return m.change(journalEntry{Op: "clear", Path: path})
+}
+
+func (m *verMeta) setTag(tag, message string) error {
+	return m.change(journalEntry{Op: "tag", Name: tag, Message: message})
+}
+
+// change journals a mutation before applying it, so that a version whose
+// process dies before finalizing it can be recovered.
+func (m *verMeta) change(entry journalEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.changeLocked(entry)
+}
+
+func (m *verMeta) changeLocked(entry journalEntry) error {
+	if err := m.record(entry); err != nil {
+		return err
+	}
+
+	m.apply(entry)
+	m.modified = true
+	return nil
+}
+
+func (m *verMeta) record(entry journalEntry) error {
+	if m.journal == nil {
+		if err := os.MkdirAll(path.Dir(m.journalPath), 0755); err != nil {
+			return err
+		}
+
+		journal, err := os.OpenFile(m.journalPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		m.journal = journal
+	}
+
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.journal.Write(append(js, '\n')); err != nil {
+		return err
+	}
+
+	return m.journal.Sync()
+}
+
+func (m *verMeta) apply(entry journalEntry) {
+	switch entry.Op {
+	case "remove":
+		m.deleted[entry.Path] = true
+		m.clearSums(entry.Path)
+	case "undelete":
+		delete(m.deleted, entry.Path)
+	case "create":
+		// a copy of its own replaces the entry the version referenced
+		m.deleted[entry.Path] = false
+		delete(m.refs, entry.Path)
+		m.clearSums(entry.Path)
+	case "modify":
+		delete(m.refs, entry.Path)
+		m.clearSums(entry.Path)
+	case "sum":
+		m.sums[entry.Path] = entry.Name
+	case "unsum":
+		delete(m.sums, entry.Path)
+	case "ref":
+		m.refs[entry.Path] = entry.Name
+	case "unref":
+		delete(m.refs, entry.Path)
+	case "clear":
+		for deletedPath := range m.deleted {
+			if isSubPath(deletedPath, entry.Path) {
+				delete(m.deleted, deletedPath)
+			}
+		}
+		for refPath := range m.refs {
+			if isSubPath(refPath, entry.Path) {
+				delete(m.refs, refPath)
+			}
+		}
+	case "tag":
+		m.tag = entry.Name
+		m.message = entry.Message
+	}
+}
+
+func (m *verMeta) replay() error {
+	journal, err := os.Open(m.journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last entry may have been cut short by a crash
+			break
+		}
+
+		m.apply(entry)
+		m.modified = true
+	}
+
+	return scanner.Err()
+}
+
+func (m *verMeta) empty() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, deleted := range m.deleted {
+		if deleted {
+			return false
+		}
+	}
+
+	return len(m.refs) == 0 && m.tag == "" && m.message == ""
+}
+
+func (m *verMeta) load() error {
+	if err := m.loadFile(); err != nil {
+		return err
+	}
+
+	return m.replay()
+}
+
+func (m *verMeta) loadFile() error {
+	bytes, err := m.backend.ReadMeta(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var vd verFmt
+	if err := json.Unmarshal(bytes, &vd); err != nil {
+		return err
+	}
+
+	m.deleted = make(map[string]bool)
+	for _, path := range vd.Deleted {
+		m.deleted[path] = true
+	}
+
+	m.refs = make(map[string]string)
+	for path, name := range vd.Refs {
+		m.refs[path] = name
+	}
+
+	m.sums = make(map[string]string)
+	for path, sum := range vd.Sums {
+		m.sums[path] = sum
+	}
+
+	m.tag = vd.Tag
+	m.message = vd.Message
+
+	m.modified = false
+	return nil
+}
+
+func (m *verMeta) checkRedundantDel(child string) bool {
+	parent := path.Dir(child)
+	if parent == "/" {
+		return false
+	}
+
+	if deleted, _ := m.deleted[parent]; deleted {
+		return true
+	}
+
+	return m.checkRedundantDel(parent)
+}
+
+// save holds the lock throughout, so that no change can slip in between
+// writing the metadata and dropping the journal that recorded it.
+func (m *verMeta) save() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.modified {
+		return nil
+	}
+
+	vd := verFmt{Refs: m.refs, Sums: m.sums, Tag: m.tag, Message: m.message}
+	for path, deleted := range m.deleted {
+		if !deleted {
+			continue
+		}
+
+		if m.checkRedundantDel(path) {
+			continue
+		}
+
+		vd.Deleted = append(vd.Deleted, path)
+	}
+
+	js, err := json.Marshal(vd)
+	if err != nil {
+		return err
+	}
+
+	if err := m.backend.WriteMeta(m.path, js); err != nil {
+		return err
+	}
+
+	return m.dropJournal()
+}
+
+// discard drops the journal of a version that is removed.
+func (m *verMeta) discard() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.dropJournal()
+}
+
+func (m *verMeta) dropJournal() error {
+	if m.journal != nil {
+		m.journal.Close()
+		m.journal = nil
+	}
+
+	if err := os.Remove(m.journalPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+//
+//	migration
+//
+
+type migration struct {
+	description string
+	apply       func(m *migrator) error
+}
+
+// migrations[n] upgrades a database from format n to format n+1.
+var migrations = []migration{
+	{"record the checksums of stored files", migrateChecksums},
+}
+
+//
+//	migrator
+//
+
+type migrator struct {
+	db     *Database
+	dryRun bool
+	out    io.Writer
+	format int
+}
+
+func (m *migrator) action(desc string, apply func() error) error {
+	if m.dryRun {
+		fmt.Fprintf(m.out, "\twould %s\n", desc)
+		return nil
+	}
+
+	fmt.Fprintf(m.out, "\t%s\n", desc)
+	return apply()
+}
+
+func (m *migrator) backupPath(names ...string) string {
+	return m.db.AreaPath(append([]string{"backup", fmt.Sprintf("format-%d", m.format)}, names...)...)
+}
+
+// Backups are never overwritten, so that running an interrupted migration
+// again keeps the files as they were before the first attempt.
+func (m *migrator) backup(read func() ([]byte, error), names ...string) error {
+	dst := m.backupPath(names...)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	data, err := read()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(dst, data, 0644)
+}
+
+func (m *migrator) run() error {
+	format, err := m.db.readFormat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case format > dbFormat:
+		return fmt.Errorf("database format %d is newer than the supported format %d", format, dbFormat)
+	case format == dbFormat:
+		fmt.Fprintf(m.out, "database is already at format %d\n", format)
+		return nil
+	}
+
+	for m.format = format; m.format < dbFormat; m.format++ {
+		step := migrations[m.format]
+		fmt.Fprintf(m.out, "format %d to %d: %s\n", m.format, m.format+1, step.description)
+
+		if err := step.apply(m); err != nil {
+			return err
+		}
+
+		if !m.dryRun {
+			if err := m.db.setFormat(m.format + 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.dryRun {
+		fmt.Fprintf(m.out, "database would be upgraded to format %d\n", dbFormat)
+	} else {
+		fmt.Fprintf(m.out, "database upgraded to format %d\n", dbFormat)
+	}
+
+	return nil
+}
+
+//
+//	format 0 to 1
+//
+
+// Format 0 databases hold nothing but version directories whose metadata
+// lists deleted paths; the checksums of their files are recorded.
+func migrateChecksums(m *migrator) error {
+	infos, err := m.db.backend.List("")
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		// foreign directories are left alone
+		timestamp, err := parseVerName(info.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := m.recordSums(info.Name(), timestamp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *migrator) recordSums(name string, timestamp time.Time) error {
+	ver, err := newVer(name, timestamp, m.db)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	missing, err := m.missingSums(ver)
+	if err != nil || missing == 0 {
+		return err
+	}
+
+	metaPath := path.Join(name, "meta.json")
+	rewrite := func() error {
+		readMeta := func() ([]byte, error) { return m.db.backend.ReadMeta(metaPath) }
+		if err := m.backup(readMeta, name, "meta.json"); err != nil {
+			return err
+		}
+
+		if err := ver.updateSums(); err != nil {
+			return err
+		}
+
+		return ver.meta.save()
+	}
+
+	return m.action(fmt.Sprintf("rewrite %s/meta.json (record %d checksums)", name, missing), rewrite)
+}
+
+func (m *migrator) missingSums(ver *Version) (int, error) {
+	var missing int
+	err := walkFiles(m.db.backend, ver.rebasePath(), func(name string, info os.FileInfo) error {
+		if _, ok := ver.meta.sum(name); !ok {
+			missing++
+		}
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return missing, nil
+}
+
+// Migrate upgrades the database to the current format one step at a time,
+// describing each change to out; with dryRun set, nothing is changed. The
+// database is locked for the duration of the migration.
+func (db *Database) Migrate(dryRun bool, out io.Writer) error {
+	if err := db.acquireLock(); err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	m := &migrator{db: db, dryRun: dryRun, out: out}
+	return m.run()
+}
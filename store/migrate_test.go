@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baselineFiles is a database as written by the first release: version
+// directories only, with metadata that lists deleted paths.
+var baselineFiles = map[string]string{
+	"ver_00000000559a17e4/root/a":       "one",
+	"ver_00000000559a17e4/root/d/b":     "two",
+	"ver_00000000559a17e4/meta.json":    `{"deleted":null}`,
+	"ver_00000000559a19b4/root/d/c":     "three",
+	"ver_00000000559a19b4/meta.json":    `{"deleted":["/a"]}`,
+	"ver_00000000559a1a00/root":         "dir",
+	"ver_00000000559a1a00/meta.json":    `{"deleted":["/d/b"]}`,
+	"lock":                              "user data",
+	"notes.squash/ver_00000000559a17e4": "user data",
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	dir := tempDir(t)
+	hostFiles(t, dir, 0, baselineFiles)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Lock(); err == nil {
+		t.Fatal("locked a database in format 0")
+	}
+
+	expected := readVersions(t, db)
+	if len(expected) != 3 {
+		t.Fatalf("found %d versions", len(expected))
+	}
+
+	var out bytes.Buffer
+	if err := db.Migrate(true, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"would rewrite ver_00000000559a17e4/meta.json (record 2 checksums)",
+		"would rewrite ver_00000000559a19b4/meta.json (record 1 checksums)",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("dry run does not %s:\n%s", line, out.String())
+		}
+	}
+
+	if format, err := db.readFormat(); err != nil || format != 0 {
+		t.Fatalf("dry run changed the format to %d (%v)", format, err)
+	}
+
+	out.Reset()
+	if err := db.Migrate(false, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "ver_00000000559a1a00") {
+		t.Errorf("rewrote a version without files:\n%s", out.String())
+	}
+
+	if format, err := db.readFormat(); err != nil || format != dbFormat {
+		t.Fatalf("migrated to format %d (%v)", format, err)
+	}
+
+	backup, err := ioutil.ReadFile(db.AreaPath("backup", "format-0", "ver_00000000559a19b4", "meta.json"))
+	if err != nil || string(backup) != baselineFiles["ver_00000000559a19b4/meta.json"] {
+		t.Errorf("backup reads %q (%v)", backup, err)
+	}
+
+	// foreign entries are left as they were
+	for _, name := range []string{"lock", "notes.squash/ver_00000000559a17e4"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != "user data" {
+			t.Errorf("%s reads %q (%v)", name, data, err)
+		}
+	}
+
+	actual := readVersions(t, db)
+	for i := range expected {
+		compareTrees(t, "migrated", expected[i], actual[i])
+	}
+
+	if err := db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.Verify(0, func(index int, path string, err error) {
+		t.Errorf("version %d: %s: %v", index, path, err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Verified != 3 || result.Unchecked != 0 {
+		t.Errorf("verified %d files, %d unchecked", result.Verified, result.Unchecked)
+	}
+
+	if err := db.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+//
+//	Node
+//
+
+const (
+	NodeFlagDir = 1 << iota
+	NodeFlagNew
+)
+
+const (
+	AttrMode = 1 << iota
+	AttrUid
+	AttrGid
+	AttrAtime
+	AttrMtime
+)
+
+type Attr struct {
+	Inode  uint64
+	Size   uint64
+	Blocks uint64
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+	Mode   os.FileMode
+	Nlink  uint32
+	Uid    uint32
+	Gid    uint32
+	Rdev   uint32
+}
+
+type Node struct {
+	path   string
+	ver    *Version
+	parent *Node
+	flags  int
+}
+
+func newNode(path string, ver *Version, parent *Node, flags int) *Node {
+	return &Node{path, ver, parent, flags}
+}
+
+func (n *Node) setAttr(attr Attr, valid int) (Attr, error) {
+	result, err := n.attr()
+	if err != nil {
+		return result, err
+	}
+
+	if valid&AttrMode != 0 {
+		if err := n.ver.db.backend.Chmod(n.rebasedPath(), attr.Mode); err != nil {
+			return result, err
+		}
+
+		result.Mode = attr.Mode
+	}
+
+	if setGid, setUid := valid&AttrGid != 0, valid&AttrUid != 0; setGid || setUid {
+		if setGid {
+			result.Gid = attr.Gid
+		}
+		if setUid {
+			result.Uid = attr.Uid
+		}
+
+		if err := n.ver.db.backend.Chown(n.rebasedPath(), int(result.Uid), int(result.Gid)); err != nil {
+			return result, err
+		}
+	}
+
+	if setAtime, setMtime := valid&AttrAtime != 0, valid&AttrMtime != 0; setAtime || setMtime {
+		if setAtime {
+			result.Atime = attr.Atime
+		}
+		if setMtime {
+			result.Mtime = attr.Mtime
+		}
+
+		if err := n.ver.db.backend.Chtimes(n.rebasedPath(), result.Atime, result.Mtime); err != nil {
+			return result, err
+		}
+	}
+
+	return result, n.ver.meta.modifyNode(n.path)
+}
+
+func (n *Node) same(other *Node) bool {
+	return n.ver == other.ver && n.path == other.path && n.flags&NodeFlagDir == other.flags&NodeFlagDir
+}
+
+func (n *Node) versioned() bool {
+	return n.ver == n.ver.db.lastVer()
+}
+
+func (n *Node) rebasedPath() string {
+	return n.ver.rebasePath(n.path)
+}
+
+func (n *Node) owner(stat syscall.Stat_t) (gid, uid uint32) {
+	gid = stat.Gid
+	uid = stat.Uid
+	return
+}
+
+func (n *Node) times(stat syscall.Stat_t) (atime, mtime, ctime time.Time) {
+	atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	mtime = time.Unix(int64(stat.Mtim.Sec), int64(stat.Mtim.Nsec))
+	ctime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+	return
+}
+
+func (n *Node) attr() (Attr, error) {
+	info, err := n.ver.db.backend.Stat(n.rebasedPath())
+	if err != nil {
+		return Attr{}, err
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+
+	var attr Attr
+	attr.Size = uint64(stat.Size)
+	attr.Blocks = uint64(stat.Blocks)
+	attr.Atime, attr.Mtime, attr.Ctime = n.times(*stat)
+	attr.Mode = info.Mode()
+	attr.Nlink = uint32(stat.Nlink)
+	attr.Gid, attr.Uid = n.owner(*stat)
+	attr.Rdev = uint32(stat.Rdev)
+
+	return attr, nil
+}
+
+func (n *Node) Path() string {
+	return n.path
+}
+
+func (n *Node) Version() *Version {
+	return n.ver
+}
+
+func (n *Node) IsDir() bool {
+	return n.flags&NodeFlagDir == NodeFlagDir
+}
+
+func (n *Node) Stat() (os.FileInfo, error) {
+	return n.ver.db.backend.Lstat(n.rebasedPath())
+}
+
+func (n *Node) Open() (BackendFile, error) {
+	return n.ver.db.backend.Open(n.rebasedPath())
+}
+
+//
+// verNodeMap
+//
+
+type verNodeMap map[string]*Node
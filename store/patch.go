@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	patchContext  = 3
+	patchMaxEdits = 2048
+)
+
+//
+//	diffOp
+//
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		index := bytes.IndexByte(data, '\n')
+		if index < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+
+		lines = append(lines, string(data[:index+1]))
+		data = data[index+1:]
+	}
+
+	return lines
+}
+
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+func diffLines(a, b []string) []diffOp {
+	var prefix, suffix []diffOp
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append([]diffOp{{' ', a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	ops := append(prefix, diffMiddle(a, b)...)
+	return append(ops, suffix...)
+}
+
+func diffMiddle(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+
+	var trace [][]int
+	v := map[int]int{1: 0}
+
+	found := false
+	for d := 0; d <= n+m && d <= patchMaxEdits && !found; d++ {
+		snapshot := make([]int, 2*d+3)
+		for k := -d - 1; k <= d+1; k++ {
+			snapshot[k+d+1] = v[k]
+		}
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1] < v[k+1]) {
+				x = v[k+1]
+			} else {
+				x = v[k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+
+			v[k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		var ops []diffOp
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+
+		return ops
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		get := func(k int) int { return trace[d][k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := get(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+
+	return ops
+}
+
+func formatUnified(oldName, newName string, ops []diffOp) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+
+	for start := 0; start < len(ops); {
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+
+		if start == len(ops) {
+			break
+		}
+
+		first := start - patchContext
+		if first < 0 {
+			first = 0
+		}
+
+		last := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				last = i
+			} else if i-last > 2*patchContext {
+				break
+			}
+		}
+
+		end := last + patchContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		oldStart, newStart := 1, 1
+		for _, op := range ops[:first] {
+			if op.kind != '+' {
+				oldStart++
+			}
+			if op.kind != '-' {
+				newStart++
+			}
+		}
+
+		oldCount, newCount := 0, 0
+		for _, op := range ops[first:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, op := range ops[first:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		start = end
+	}
+
+	return buf.String()
+}
+
+//
+//	Change
+//
+
+func (c *Change) BuildPatch(maxSize int64) (string, error) {
+	if c.Dir || c.Change == "attributes" {
+		return "", nil
+	}
+
+	oldName, newName := "a"+c.Path, "b"+c.Path
+	if c.old == nil {
+		oldName = "/dev/null"
+	}
+	if c.new == nil {
+		newName = "/dev/null"
+	}
+
+	var oldData, newData []byte
+	for _, side := range []struct {
+		node *Node
+		data *[]byte
+	}{{c.old, &oldData}, {c.new, &newData}} {
+		if side.node == nil {
+			continue
+		}
+
+		backend := side.node.ver.db.backend
+
+		info, err := backend.Lstat(side.node.rebasedPath())
+		if err != nil {
+			return "", err
+		}
+
+		if !info.Mode().IsRegular() {
+			return "", nil
+		}
+
+		if info.Size() > maxSize {
+			return fmt.Sprintf("Files %s and %s differ (larger than %d bytes)\n", oldName, newName, maxSize), nil
+		}
+
+		if *side.data, err = readFile(backend, side.node.rebasedPath()); err != nil {
+			return "", err
+		}
+	}
+
+	if isBinary(oldData) || isBinary(newData) {
+		return fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName), nil
+	}
+
+	return formatUnified(oldName, newName, diffLines(splitLines(oldData), splitLines(newData))), nil
+}
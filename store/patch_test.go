@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	for _, test := range []struct {
+		data  string
+		lines []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\n\nb", []string{"a\n", "\n", "b"}},
+	} {
+		if lines := splitLines([]byte(test.data)); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%q: expected %q, got %q", test.data, test.lines, lines)
+		}
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	if isBinary([]byte("plain text\n")) {
+		t.Error("text reported as binary")
+	}
+
+	if !isBinary([]byte("a\x00b")) {
+		t.Error("nul byte not reported as binary")
+	}
+
+	if isBinary(append([]byte(strings.Repeat("a", 8000)), 0)) {
+		t.Error("nul byte past the sniffed prefix reported as binary")
+	}
+}
+
+func TestFormatUnified(t *testing.T) {
+	for _, test := range []struct {
+		label, old, new, patch string
+	}{
+		{"change", "one\ntwo\nthree\n", "one\n2\nthree\n", "--- a\n+++ b\n" +
+			"@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"},
+		{"context", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nx\n6\n7\n8\n9\n", "--- a\n+++ b\n" +
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n"},
+		{"hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\ny\n", "--- a\n+++ b\n" +
+			"@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n" +
+			"@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+y\n"},
+		{"newline", "x", "y", "--- a\n+++ b\n" +
+			"@@ -1,1 +1,1 @@\n-x\n\\ No newline at end of file\n+y\n\\ No newline at end of file\n"},
+		{"created", "", "a\nb\n", "--- a\n+++ b\n" +
+			"@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"emptied", "a\nb\n", "", "--- a\n+++ b\n" +
+			"@@ -1,2 +0,0 @@\n-a\n-b\n"},
+	} {
+		ops := diffLines(splitLines([]byte(test.old)), splitLines([]byte(test.new)))
+		if patch := formatUnified("a", "b", ops); patch != test.patch {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.label, test.patch, patch)
+		}
+	}
+}
+
+// applyUnified applies a patch produced by formatUnified to the lines it was
+// built from, all of which end with a newline.
+func applyUnified(t *testing.T, old []string, patch string) []string {
+	lines := strings.SplitAfter(patch, "\n")
+	if len(lines) < 2 || lines[0] != "--- a\n" || lines[1] != "+++ b\n" {
+		t.Fatalf("invalid patch header:\n%s", patch)
+	}
+
+	var result []string
+	next := 0
+	for _, line := range lines[2:] {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "@@ "):
+			var oldStart, oldCount, newStart, newCount int
+			if _, err := fmt.Sscanf(line, "@@ -%d,%d +%d,%d @@\n", &oldStart, &oldCount, &newStart, &newCount); err != nil {
+				t.Fatalf("invalid hunk header %q: %v", line, err)
+			}
+
+			if oldCount > 0 {
+				oldStart--
+			}
+
+			if oldStart < next {
+				t.Fatalf("overlapping hunk %q", line)
+			}
+
+			result = append(result, old[next:oldStart]...)
+			next = oldStart
+		case line[0] == ' ':
+			if old[next] != line[1:] {
+				t.Fatalf("context %q does not match %q", line, old[next])
+			}
+
+			result = append(result, old[next])
+			next++
+		case line[0] == '-':
+			next++
+		case line[0] == '+':
+			result = append(result, line[1:])
+		default:
+			t.Fatalf("invalid patch line %q", line)
+		}
+	}
+
+	return append(result, old[next:]...)
+}
+
+func TestDiffLinesApply(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	randomLines := func(base []string) []string {
+		var lines []string
+		for _, line := range base {
+			switch rnd.Intn(6) {
+			case 0:
+			case 1:
+				lines = append(lines, strconv.Itoa(rnd.Intn(10))+"\n")
+			case 2:
+				lines = append(lines, line, strconv.Itoa(rnd.Intn(10))+"\n")
+			default:
+				lines = append(lines, line)
+			}
+		}
+
+		return lines
+	}
+
+	for i := 0; i < 200; i++ {
+		var old []string
+		for j := rnd.Intn(40); j > 0; j-- {
+			old = append(old, strconv.Itoa(rnd.Intn(10))+"\n")
+		}
+
+		new := randomLines(old)
+
+		ops := diffLines(old, new)
+		var a, b []string
+		for _, op := range ops {
+			if op.kind != '+' {
+				a = append(a, op.line)
+			}
+			if op.kind != '-' {
+				b = append(b, op.line)
+			}
+		}
+
+		if !reflect.DeepEqual(a, old) || !reflect.DeepEqual(b, new) {
+			t.Fatalf("edit script does not reproduce %q and %q", old, new)
+		}
+
+		if patched := applyUnified(t, old, formatUnified("a", "b", ops)); strings.Join(patched, "") != strings.Join(new, "") {
+			t.Fatalf("patch of %q produced %q, expected %q", old, patched, new)
+		}
+	}
+}
+
+func TestBuildPatch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/text", "one\ntwo\n")
+		writeFile(t, db, "/binary", "a\x00b")
+		writeFile(t, db, "/large", "small")
+		writeFile(t, db, "/removed", "gone\n")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/text", "one\n2\n")
+		writeFile(t, db, "/binary", "a\x00c")
+		writeFile(t, db, "/large", strings.Repeat("large\n", 100))
+		writeFile(t, db, "/added", "new")
+		removeAll(t, db, "/removed")
+		unmount(t, db)
+
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		changes, err := db.Diff(1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{
+			"/text":    "--- a/text\n+++ b/text\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n",
+			"/binary":  "Binary files a/binary and b/binary differ\n",
+			"/large":   "Files a/large and b/large differ (larger than 64 bytes)\n",
+			"/added":   "--- /dev/null\n+++ b/added\n@@ -0,0 +1,1 @@\n+new\n\\ No newline at end of file\n",
+			"/removed": "--- a/removed\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-gone\n",
+		}
+
+		patches := make(map[string]string)
+		for i := range changes {
+			patch, err := changes[i].BuildPatch(64)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patches[changes[i].Path] = patch
+		}
+
+		if !reflect.DeepEqual(patches, expected) {
+			t.Errorf("expected %q, got %q", expected, patches)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"log"
+	"time"
+)
+
+//
+//	Policy
+//
+
+type Policy struct {
+	Interval  time.Duration
+	Threshold uint64
+	Idle      time.Duration
+}
+
+func (p Policy) Enabled() bool {
+	return p.Interval > 0 || p.Threshold > 0 || p.Idle > 0
+}
+
+// Policies are evaluated once per second, so shorter intervals behave as if
+// they were one second long.
+func (p Policy) due(db *Database, now time.Time) bool {
+	head := db.vers[len(db.vers)-1]
+	if !head.meta.modified || db.writers > 0 || !now.After(head.timestamp) {
+		return false
+	}
+
+	if p.Interval > 0 && now.Sub(head.timestamp) >= p.Interval {
+		return true
+	}
+
+	if p.Threshold > 0 && db.written >= p.Threshold {
+		return true
+	}
+
+	if p.Idle > 0 && db.touched.After(head.timestamp) && now.Sub(db.touched) >= p.Idle {
+		return true
+	}
+
+	return false
+}
+
+//
+//	Database
+//
+
+// Watch cuts new versions of a mounted database as the policy demands until
+// the returned function is called.
+func (db *Database) Watch(policy Policy) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case now := <-ticker.C:
+				if err := db.autoCheckpoint(policy, now); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+func (db *Database) autoCheckpoint(policy Policy, now time.Time) error {
+	return db.checkpoint(now, func() (bool, error) {
+		return policy.due(db, now), nil
+	})
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPolicyDue(t *testing.T) {
+	db, err := OpenBackend(tempDir(t), NewMemoryBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount(t, db)
+	head := db.Head()
+	start := head.timestamp
+
+	for _, test := range []struct {
+		label    string
+		policy   Policy
+		modified bool
+		writers  int
+		written  uint64
+		touched  time.Duration
+		elapsed  time.Duration
+		due      bool
+	}{
+		{"unmodified", Policy{Interval: time.Minute}, false, 0, 0, 0, time.Hour, false},
+		{"interval", Policy{Interval: time.Minute}, true, 0, 0, 0, time.Minute, true},
+		{"interval pending", Policy{Interval: time.Minute}, true, 0, 0, 0, time.Second, false},
+		{"threshold", Policy{Threshold: 100}, true, 0, 100, 0, time.Second, true},
+		{"threshold pending", Policy{Threshold: 100}, true, 0, 99, 0, time.Second, false},
+		{"idle", Policy{Idle: time.Minute}, true, 0, 0, time.Second, time.Minute + time.Second, true},
+		{"idle pending", Policy{Idle: time.Minute}, true, 0, 0, time.Second, time.Minute, false},
+		{"idle untouched", Policy{Idle: time.Minute}, true, 0, 0, -time.Second, time.Hour, false},
+		{"writers", Policy{Interval: time.Minute}, true, 1, 0, 0, time.Hour, false},
+		{"clock", Policy{Interval: time.Minute}, true, 0, 100, 0, 0, false},
+	} {
+		head.meta.modified = test.modified
+		db.writers = test.writers
+		db.written = test.written
+		db.touched = start.Add(test.touched)
+
+		if due := test.policy.due(db, start.Add(test.elapsed)); due != test.due {
+			t.Errorf("%s: expected due %v, got %v", test.label, test.due, due)
+		}
+	}
+
+	db.writers = 0
+	unmount(t, db)
+}
+
+func TestCheckpoint(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+
+		_, handle, err := db.Root().CreateFile("b", os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Checkpoint(); err == nil {
+			t.Error("checkpoint with a file open for writing")
+		}
+
+		if err := handle.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFile(t, db, "/a", "two")
+		unmount(t, db)
+
+		trees := readVersions(t, db)
+		if len(trees) != 2 {
+			t.Fatalf("expected 2 versions, got %d", len(trees))
+		}
+
+		compareTrees(t, "first", map[string]string{"/": "dir", "/a": "file:one", "/b": "file:"}, trees[0])
+		compareTrees(t, "second", map[string]string{"/": "dir", "/a": "file:two", "/b": "file:"}, trees[1])
+	})
+}
+
+// Versions cut while the mount keeps changing must not be written to after
+// they are finalized, which their checksums would reveal.
+func TestCheckpointConcurrent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+
+		const count = 30
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < count; i++ {
+				writeFile(t, db, fmt.Sprintf("/d%d/f", i), fmt.Sprint(i))
+				writeFile(t, db, "/g", fmt.Sprint(i))
+				removeAll(t, db, fmt.Sprintf("/d%d", i-1))
+			}
+		}()
+
+		policy := Policy{Threshold: 1}
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+
+			if err := db.autoCheckpoint(policy, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		unmount(t, db)
+
+		other := reopen(t, db)
+		if err := other.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := other.Verify(0, func(index int, path string, err error) {
+			t.Errorf("version %d: %s: %v", index, path, err)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Unchecked > 0 {
+			t.Errorf("%d files without checksums", result.Unchecked)
+		}
+
+		trees := readVersions(t, db)
+		expected := map[string]string{"/": "dir", "/g": fmt.Sprintf("file:%d", count-1), fmt.Sprintf("/d%d", count-1): "dir", fmt.Sprintf("/d%d/f", count-1): fmt.Sprintf("file:%d", count-1)}
+		compareTrees(t, "head", expected, trees[len(trees)-1])
+	})
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+//
+//	Version
+//
+
+func (v *Version) reveal(dir, name string) error {
+	if deleted, _ := v.meta.deleted[dir]; !deleted {
+		return nil
+	}
+
+	if err := v.meta.createNode(dir); err != nil {
+		return err
+	}
+
+	nodes, err := v.scanDir(dir)
+	if err != nil {
+		return err
+	}
+
+	next := childOnPath(dir, name)
+	for _, node := range nodes {
+		if node.path == next {
+			continue
+		}
+
+		if err := v.meta.removeNode(node.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *Version) restore(src *Version, name string) error {
+	// the tree of a mounted version follows the files written since, so the
+	// source is resolved afresh
+	srcRoot := src.root
+	if srcRoot == nil || srcRoot == v.db.root {
+		var err error
+		if srcRoot, err = src.build(); err != nil {
+			return err
+		}
+	}
+
+	srcNode := srcRoot.LookupNode(name)
+	if srcNode == nil {
+		return fmt.Errorf("path not found in version: %s", name)
+	}
+
+	for _, dir := range parentPaths(name) {
+		if err := v.reveal(dir, name); err != nil {
+			return err
+		}
+
+		nodes, err := v.scanDir(path.Dir(dir))
+		if err != nil {
+			return err
+		}
+
+		if node, ok := nodes[path.Base(dir)]; !ok || node.flags&NodeFlagDir == 0 {
+			if err := v.meta.refNode(dir, srcRoot.LookupNode(dir).ver.name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := v.meta.clearNode(name); err != nil {
+		return err
+	}
+
+	if err := v.db.backend.RemoveAll(v.rebasePath(name)); err != nil {
+		return err
+	}
+
+	var baseNodes verNodeMap
+	if v.parent != nil {
+		var err error
+		if baseNodes, err = v.parent.scanDir(path.Dir(name)); err != nil {
+			return err
+		}
+	}
+
+	if node, ok := baseNodes[path.Base(name)]; !ok || node.ver != srcNode.ver || node.flags&NodeFlagDir != srcNode.flags&NodeFlagDir {
+		if err := v.meta.refNode(name, srcNode.ver.name()); err != nil {
+			return err
+		}
+	}
+
+	if srcDir := srcRoot.Lookup(name); srcDir != nil {
+		plan, err := v.db.planVer(v.parent, srcDir, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, node := range plan.refs {
+			if err := v.meta.refNode(node.path, node.ver.name()); err != nil {
+				return err
+			}
+		}
+
+		for _, path := range plan.deleted {
+			if err := v.meta.removeNode(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	root, err := v.build()
+	if err != nil {
+		return err
+	}
+
+	expected, err := buildSubtreeSig(srcRoot, name)
+	if err != nil {
+		return err
+	}
+
+	actual, err := buildSubtreeSig(root, name)
+	if err != nil {
+		return err
+	}
+
+	if paths := expected.diff(actual); len(paths) > 0 {
+		return fmt.Errorf("restored path does not resolve identically: %s", strings.Join(paths, ", "))
+	}
+
+	return nil
+}
+
+//
+//	Dir
+//
+
+type staleEntry struct {
+	dir  *Dir
+	name string
+}
+
+// refresh rebuilds the entries of a loaded directory on the way to a
+// restored path, returning those that were replaced.
+func (vd *Dir) refresh(ver *Version, name string) ([]staleEntry, error) {
+	nodes, err := ver.scanDir(vd.node.path)
+	if err != nil {
+		return nil, err
+	}
+
+	vd.mutex.Lock()
+
+	var stale []staleEntry
+	for childName, dir := range vd.dirs {
+		if node, ok := nodes[childName]; !ok || node.path == name || !dir.node.same(node) {
+			delete(vd.dirs, childName)
+			stale = append(stale, staleEntry{vd, childName})
+		}
+	}
+
+	for childName, file := range vd.files {
+		if node, ok := nodes[childName]; !ok || node.path == name || !file.node.same(node) {
+			delete(vd.files, childName)
+			stale = append(stale, staleEntry{vd, childName})
+		}
+	}
+
+	for childName, node := range nodes {
+		if vd.has(childName) {
+			continue
+		}
+
+		if node.flags&NodeFlagDir == NodeFlagDir {
+			subDir := newDir(node, vd)
+			if err := ver.buildDir(subDir); err != nil {
+				vd.mutex.Unlock()
+				return nil, err
+			}
+
+			vd.dirs[childName] = subDir
+		} else {
+			vd.files[childName] = newFile(node, vd)
+		}
+	}
+
+	next := childOnPath(vd.node.path, name)
+	subDir, _ := vd.dirs[path.Base(next)]
+
+	vd.mutex.Unlock()
+
+	if subDir != nil && next != name {
+		subStale, err := subDir.refresh(ver, name)
+		return append(stale, subStale...), err
+	}
+
+	return stale, nil
+}
+
+//
+//	Database
+//
+
+// RestoreLive restores paths from a version into the head of a mounted
+// database, updating its loaded tree. The database is locked meanwhile, and
+// paths with files open for writing are refused.
+func (db *Database) RestoreLive(index uint, paths []string) error {
+	db.mutex.Lock()
+	stale, err := db.restoreLive(index, paths)
+	db.mutex.Unlock()
+
+	// the kernel may wait for requests that need the database while it
+	// invalidates entries, so this happens once it is unlocked
+	if invalidate := db.invalidate; invalidate != nil {
+		for _, entry := range stale {
+			invalidate(entry.dir, entry.name)
+		}
+	}
+
+	return err
+}
+
+func (db *Database) restoreLive(index uint, paths []string) ([]staleEntry, error) {
+	if index == 0 || index >= uint(len(db.vers)) {
+		return nil, errors.New("invalid version index")
+	}
+
+	for handle := range db.handles {
+		if !handle.writable {
+			continue
+		}
+
+		for _, name := range paths {
+			if filePath := handle.node.Node().path; isSubPath(filePath, name) {
+				return nil, fmt.Errorf("file is open for writing: %s", filePath)
+			}
+		}
+	}
+
+	head := db.vers[len(db.vers)-1]
+	src := db.vers[index-1]
+
+	var stale []staleEntry
+	for _, name := range paths {
+		if err := head.restore(src, name); err != nil {
+			return stale, err
+		}
+
+		entries, err := db.root.refresh(head, name)
+		stale = append(stale, entries...)
+		if err != nil {
+			return stale, err
+		}
+	}
+
+	return stale, nil
+}
+
+// Restore creates a new version with paths restored from an earlier one.
+func (db *Database) Restore(index uint, paths []string) (*Version, error) {
+	if index == 0 || index > uint(len(db.vers)) {
+		return nil, errors.New("invalid version index")
+	}
+
+	timestamp := time.Now()
+	if err := db.checkTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	dir, err := db.createVerDir(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ver, err := newVer(dir, timestamp, db)
+	if err != nil {
+		return nil, err
+	}
+
+	ver.parent = db.lastVer()
+
+	src := db.vers[index-1]
+	for _, name := range paths {
+		if err := ver.restore(src, name); err != nil {
+			db.backend.RemoveAll(ver.dir)
+			return nil, err
+		}
+	}
+
+	if err := ver.updateSums(); err != nil {
+		db.backend.RemoveAll(ver.dir)
+		return nil, err
+	}
+
+	if err := ver.meta.save(); err != nil {
+		return nil, err
+	}
+
+	db.addVer(ver)
+	return ver, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRestoreLive(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a/f", "one")
+		writeFile(t, db, "/b", "two")
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFile(t, db, "/a/f", "three")
+		removeAll(t, db, "/b")
+
+		var invalidated []string
+		db.SetInvalidate(func(dir *Dir, name string) {
+			invalidated = append(invalidated, name)
+		})
+
+		if err := db.RestoreLive(1, []string{"/a/f", "/b"}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{"/": "dir", "/a": "dir", "/a/f": "file:one", "/b": "file:two"}
+		compareTrees(t, "restored", expected, readTree(t, db.Root()))
+
+		if len(invalidated) == 0 {
+			t.Error("no entries invalidated")
+		}
+
+		_, file := db.Root().Lookup("/a").Child("f")
+		handle, err := file.Open(os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.RestoreLive(1, []string{"/a"}); err == nil {
+			t.Error("restored over a file open for writing")
+		}
+
+		if err := handle.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.RestoreLive(1, []string{"/a"}); err != nil {
+			t.Fatal(err)
+		}
+
+		unmount(t, db)
+
+		trees := readVersions(t, db)
+		compareTrees(t, "saved", expected, trees[len(trees)-1])
+	})
+}
+
+func TestRestoreLiveEdit(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+		mkdirs(t, db.Root(), "/d/e")
+		writeFile(t, db, "/d/e/f", "four")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/a", "two")
+		removeAll(t, db, "/d")
+		unmount(t, db)
+
+		mount(t, db)
+		if err := db.RestoreLive(1, []string{"/a", "/d/e/f"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the copies written after the restore replace the restored entries
+		writeFile(t, db, "/a", "edited")
+		writeFile(t, db, "/d/e/f", "five")
+		unmount(t, db)
+
+		expected := map[string]string{"/": "dir", "/a": "file:edited", "/d": "dir", "/d/e": "dir", "/d/e/f": "file:five"}
+		trees := readVersions(t, db)
+		compareTrees(t, "saved", expected, trees[len(trees)-1])
+	})
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+//
+//	Database
+//
+
+// Revert creates a new version with the same contents as an earlier one.
+func (db *Database) Revert(index uint, tag, message string) (*Version, error) {
+	if index == 0 || index > uint(len(db.vers)) {
+		return nil, errors.New("invalid version index")
+	}
+
+	head := db.lastVer()
+
+	target := db.vers[index-1]
+	if err := target.resolve(); err != nil {
+		return nil, err
+	}
+
+	plan, err := db.planVer(head, target.root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now()
+	if err := db.checkTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	dir, err := db.createVerDir(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ver, err := plan.stage(dir, timestamp)
+	if err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	if err := ver.meta.setTag(tag, message); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	if err := ver.updateSums(); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	if err := ver.meta.save(); err != nil {
+		return nil, err
+	}
+
+	if err := plan.verify(ver); err != nil {
+		db.backend.RemoveAll(dir)
+		return nil, err
+	}
+
+	db.addVer(ver)
+	return ver, nil
+}
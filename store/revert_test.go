@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import "testing"
+
+func TestRevert(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+		writeFile(t, db, "/d/x", "x")
+		unmount(t, db)
+
+		mount(t, db)
+		writeFile(t, db, "/a", "two")
+		writeFile(t, db, "/b", "b")
+		removeAll(t, db, "/d")
+		unmount(t, db)
+
+		before := readVersions(t, db)
+		if err := db.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Revert(0, "", ""); err == nil {
+			t.Error("reverted to version 0")
+		}
+
+		if _, err := db.Revert(3, "", ""); err == nil {
+			t.Error("reverted to a version past the head")
+		}
+
+		ver, err := db.Revert(1, "undo", "back to the first version")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ver.Tag() != "undo" || ver.Message() != "back to the first version" {
+			t.Errorf("expected tag and message to be set, got %q and %q", ver.Tag(), ver.Message())
+		}
+
+		after := readVersions(t, db)
+		if len(after) != 3 {
+			t.Fatalf("expected 3 versions, got %d", len(after))
+		}
+
+		compareTrees(t, "first", before[0], after[0])
+		compareTrees(t, "second", before[1], after[1])
+		compareTrees(t, "reverted", before[0], after[2])
+
+		// the tag is stored with the version
+		other := reopen(t, db)
+		if err := other.Scan(); err != nil {
+			t.Fatal(err)
+		}
+
+		if tag := other.Versions()[2].Tag(); tag != "undo" {
+			t.Errorf("expected tag undo after reopening, got %q", tag)
+		}
+	})
+}
@@ -0,0 +1,1023 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+//	S3Config
+//
+
+// S3Config describes the bucket holding the versions of a database. Missing
+// credentials are taken from the usual AWS environment variables.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Cache     string `json:"cache,omitempty"`
+	Exclusive bool   `json:"exclusive,omitempty"`
+}
+
+//
+//	s3Entry
+//
+
+type s3Entry struct {
+	attr  fileAttr
+	size  int64
+	dir   bool
+	etag  string
+	work  bool
+	dirty bool
+	open  int
+	mutex sync.Mutex
+}
+
+//
+//	s3Backend
+//
+
+type s3Backend struct {
+	client    *s3Client
+	prefix    string
+	cache     string
+	exclusive bool
+	entries   map[string]*s3Entry
+	mutex     sync.Mutex
+}
+
+// NewS3Backend returns a backend that keeps versions as objects in an
+// S3-compatible bucket. Files are downloaded into the cache directory when
+// opened, and modified files are uploaded when released or when their
+// version is finalized.
+func NewS3Backend(config S3Config) (Backend, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("no s3 bucket specified")
+	}
+
+	if config.Cache == "" {
+		return nil, errors.New("no s3 cache directory specified")
+	}
+
+	if config.AccessKey == "" {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.SecretKey == "" {
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if config.Token == "" {
+		config.Token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.headBucket(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(config.Cache, "work"), 0700); err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3Backend{client: client, prefix: prefix, cache: config.Cache, exclusive: config.Exclusive, entries: make(map[string]*s3Entry)}, nil
+}
+
+// Exclusive reports whether the configuration vouches that only one host
+// writes under the prefix, as nothing in the bucket keeps others out.
+func (b *s3Backend) Exclusive() bool {
+	return b.exclusive
+}
+
+// Databases whose .vfs area holds an s3.json file keep their versions in the
+// bucket it describes; the cache defaults to the .vfs area as well.
+func loadS3Backend(base string) (Backend, error) {
+	data, err := ioutil.ReadFile(filepath.Join(base, ".vfs", "s3.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var config S3Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid s3 configuration: %s", err)
+	}
+
+	if config.Cache == "" {
+		config.Cache = filepath.Join(base, ".vfs", "cache")
+	}
+
+	return NewS3Backend(config)
+}
+
+func s3Name(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (b *s3Backend) key(name string) string {
+	return b.prefix + strings.TrimPrefix(name, "/")
+}
+
+func (b *s3Backend) dirPrefix(name string) string {
+	if name == "/" {
+		return b.prefix
+	}
+
+	return b.key(name) + "/"
+}
+
+// Clean copies are named after the object and its ETag, so that they can be
+// shared by every process using the cache; modified copies belong to the
+// single writer of the database.
+func (b *s3Backend) cachePath(name, etag string) string {
+	sum := sha256.Sum256([]byte(b.key(name) + "\x00" + etag))
+	return filepath.Join(b.cache, hex.EncodeToString(sum[:]))
+}
+
+func (b *s3Backend) workPath(name string) string {
+	sum := sha256.Sum256([]byte(b.key(name)))
+	return filepath.Join(b.cache, "work", hex.EncodeToString(sum[:]))
+}
+
+func s3Header(attr fileAttr) http.Header {
+	header := make(http.Header)
+	header.Set("X-Amz-Meta-Mode", strconv.FormatUint(uint64(attr.mode), 10))
+	header.Set("X-Amz-Meta-Uid", strconv.Itoa(attr.uid))
+	header.Set("X-Amz-Meta-Gid", strconv.Itoa(attr.gid))
+	header.Set("X-Amz-Meta-Atime", strconv.FormatInt(attr.atime.UnixNano(), 10))
+	header.Set("X-Amz-Meta-Mtime", strconv.FormatInt(attr.mtime.UnixNano(), 10))
+	return header
+}
+
+// Objects written by other tools lack attributes; they are presented as owned
+// by the current user.
+func defaultAttr(mode os.FileMode, mtime time.Time) fileAttr {
+	return fileAttr{mode, os.Geteuid(), os.Getegid(), mtime, mtime}
+}
+
+func parseS3Attr(header http.Header, mode os.FileMode) fileAttr {
+	mtime, _ := http.ParseTime(header.Get("Last-Modified"))
+	attr := defaultAttr(mode, mtime)
+
+	if value, err := strconv.ParseUint(header.Get("X-Amz-Meta-Mode"), 10, 32); err == nil {
+		attr.mode = os.FileMode(value)
+	}
+	if value, err := strconv.Atoi(header.Get("X-Amz-Meta-Uid")); err == nil {
+		attr.uid = value
+	}
+	if value, err := strconv.Atoi(header.Get("X-Amz-Meta-Gid")); err == nil {
+		attr.gid = value
+	}
+	if value, err := strconv.ParseInt(header.Get("X-Amz-Meta-Atime"), 10, 64); err == nil {
+		attr.atime = time.Unix(0, value)
+	}
+	if value, err := strconv.ParseInt(header.Get("X-Amz-Meta-Mtime"), 10, 64); err == nil {
+		attr.mtime = time.Unix(0, value)
+	}
+
+	return attr
+}
+
+// Directories are stored as empty marker objects named after the directory
+// with a trailing slash; prefixes without a marker are directories as well.
+func (b *s3Backend) fetch(name string) (*s3Entry, error) {
+	if name == "/" {
+		return &s3Entry{attr: defaultAttr(os.ModeDir|0755, time.Now()), dir: true}, nil
+	}
+
+	key := b.key(name)
+
+	if header, size, err := b.client.head(key); err == nil {
+		return &s3Entry{attr: parseS3Attr(header, 0644), size: size, etag: header.Get("ETag")}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if header, _, err := b.client.head(key + "/"); err == nil {
+		attr := parseS3Attr(header, os.ModeDir|0755)
+		attr.mode |= os.ModeDir
+		return &s3Entry{attr: attr, dir: true}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	objects, prefixes, err := b.client.list(key+"/", "/", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(objects) > 0 || len(prefixes) > 0 {
+		return &s3Entry{attr: defaultAttr(os.ModeDir|0755, time.Now()), dir: true}, nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (b *s3Backend) entry(name string) (*s3Entry, error) {
+	b.mutex.Lock()
+	entry, ok := b.entries[name]
+	b.mutex.Unlock()
+
+	if ok {
+		return entry, nil
+	}
+
+	entry, err := b.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if existing, ok := b.entries[name]; ok {
+		return existing, nil
+	}
+
+	b.entries[name] = entry
+	return entry, nil
+}
+
+func (b *s3Backend) info(name string, entry *s3Entry) (os.FileInfo, error) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	size := entry.size
+	if entry.work {
+		info, err := os.Stat(b.workPath(name))
+		if err != nil {
+			return nil, err
+		}
+
+		size = info.Size()
+	}
+
+	return newAttrInfo(path.Base(name), entry.attr, size, entry.attr.mtime), nil
+}
+
+func (b *s3Backend) Stat(name string) (os.FileInfo, error) {
+	name = s3Name(name)
+
+	entry, err := b.entry(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.info(name, entry)
+}
+
+// Symbolic links are never followed, so Lstat is the same as Stat.
+func (b *s3Backend) Lstat(name string) (os.FileInfo, error) {
+	return b.Stat(name)
+}
+
+func (b *s3Backend) Readlink(name string) (string, error) {
+	name = s3Name(name)
+
+	entry, err := b.entry(name)
+	if err != nil {
+		return "", err
+	}
+
+	if entry.attr.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+
+	file, err := b.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	link, err := ioutil.ReadAll(file)
+	return string(link), err
+}
+
+func (b *s3Backend) List(name string) ([]os.FileInfo, error) {
+	name = s3Name(name)
+
+	entry, err := b.entry(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	prefix := b.dirPrefix(name)
+	objects, prefixes, err := b.client.list(prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]os.FileInfo)
+	for _, common := range prefixes {
+		if child := strings.TrimSuffix(strings.TrimPrefix(common, prefix), "/"); child != "" {
+			infos[child] = newAttrInfo(child, defaultAttr(os.ModeDir|0755, time.Now()), 0, time.Now())
+		}
+	}
+
+	for _, object := range objects {
+		if child := strings.TrimPrefix(object.Key, prefix); child != "" {
+			infos[child] = newAttrInfo(child, defaultAttr(0644, object.LastModified), object.Size, object.LastModified)
+		}
+	}
+
+	// entries known to the backend carry full attributes and include files
+	// that have not been uploaded yet
+	b.mutex.Lock()
+	children := make(map[string]*s3Entry)
+	for childName, child := range b.entries {
+		if childName != name && path.Dir(childName) == name {
+			children[childName] = child
+		}
+	}
+	b.mutex.Unlock()
+
+	for childName, child := range children {
+		info, err := b.info(childName, child)
+		if err != nil {
+			return nil, err
+		}
+
+		infos[info.Name()] = info
+	}
+
+	var result []os.FileInfo
+	for _, info := range infos {
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+func (b *s3Backend) Open(name string) (BackendFile, error) {
+	return b.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (b *s3Backend) OpenFile(name string, flags int, mode os.FileMode) (BackendFile, error) {
+	name = s3Name(name)
+	writable := flags&syscall.O_ACCMODE != os.O_RDONLY
+
+	entry, err := b.entry(name)
+	switch {
+	case err == nil && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case err == nil && entry.dir:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case os.IsNotExist(err) && flags&os.O_CREATE != 0:
+		if entry, err = b.create(name, mode); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	truncate := writable && flags&os.O_TRUNC != 0
+
+	if writable && !entry.work {
+		if err := b.checkout(name, entry, truncate); err != nil {
+			return nil, err
+		}
+	} else if truncate {
+		if err := os.Truncate(b.workPath(name), 0); err != nil {
+			return nil, err
+		}
+
+		entry.attr.mtime = time.Now()
+		entry.dirty = true
+	}
+
+	filePath := b.workPath(name)
+	if !entry.work {
+		if filePath, err = b.download(name, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(filePath, flags&(syscall.O_ACCMODE|os.O_APPEND), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.open++
+	return &s3File{b, name, entry, file, writable}, nil
+}
+
+func (b *s3Backend) create(name string, mode os.FileMode) (*s3Entry, error) {
+	file, err := os.Create(b.workPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	entry := &s3Entry{attr: defaultAttr(mode.Perm(), time.Now()), work: true, dirty: true}
+
+	b.mutex.Lock()
+	b.entries[name] = entry
+	b.mutex.Unlock()
+
+	return entry, nil
+}
+
+// download returns the clean copy of an object, fetching it if it is not in
+// the cache yet.
+func (b *s3Backend) download(name string, entry *s3Entry) (string, error) {
+	cachePath := b.cachePath(name, entry.etag)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	body, err := b.client.get(b.key(name))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	temp, err := ioutil.TempFile(b.cache, "download")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(temp, body); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	if err := os.Rename(temp.Name(), cachePath); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	return cachePath, nil
+}
+
+// checkout prepares the work copy that writable handles of an object use
+// until it is uploaded and no longer open.
+func (b *s3Backend) checkout(name string, entry *s3Entry, truncate bool) error {
+	if truncate {
+		file, err := os.Create(b.workPath(name))
+		if err != nil {
+			return err
+		}
+
+		entry.attr.mtime = time.Now()
+		entry.dirty = true
+		entry.work = true
+		return file.Close()
+	}
+
+	cachePath, err := b.download(name, entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := copyFile(hostFS, cachePath, b.workPath(name)); err != nil {
+		return err
+	}
+
+	entry.work = true
+	return nil
+}
+
+// upload writes out the changes made to an entry; the entry must be locked.
+func (b *s3Backend) upload(name string, entry *s3Entry) error {
+	if !entry.dirty || name == "/" {
+		entry.dirty = false
+		return nil
+	}
+
+	key := b.key(name)
+	header := s3Header(entry.attr)
+
+	var (
+		etag string
+		err  error
+	)
+
+	switch {
+	case entry.dir:
+		_, err = b.client.put(key+"/", header, nil)
+	case entry.work:
+		var file *os.File
+		if file, err = os.Open(b.workPath(name)); err != nil {
+			return err
+		}
+
+		etag, err = b.client.put(key, header, file)
+		file.Close()
+	default:
+		if etag, err = b.client.copy(key, key, header); etag == "" {
+			etag = entry.etag
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	entry.dirty = false
+	if entry.dir {
+		return nil
+	}
+
+	// the clean copy of replaced contents is stale, while a copy with new
+	// metadata keeps its contents under a possibly different ETag
+	if entry.work {
+		os.Remove(b.cachePath(name, entry.etag))
+	} else if etag != entry.etag {
+		if err := os.Rename(b.cachePath(name, entry.etag), b.cachePath(name, etag)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	entry.etag = etag
+	return b.settle(name, entry)
+}
+
+// settle turns the work copy of an uploaded object that is no longer open
+// into its clean copy.
+func (b *s3Backend) settle(name string, entry *s3Entry) error {
+	if !entry.work || entry.dirty || entry.open > 0 {
+		return nil
+	}
+
+	info, err := os.Stat(b.workPath(name))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(b.workPath(name), b.cachePath(name, entry.etag)); err != nil {
+		return err
+	}
+
+	entry.size = info.Size()
+	entry.work = false
+	return nil
+}
+
+func (b *s3Backend) release(name string, entry *s3Entry, writable bool) error {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.open--
+	if writable {
+		return b.upload(name, entry)
+	}
+
+	return b.settle(name, entry)
+}
+
+// Flush uploads the modified entries below the given name; it is called when
+// a version is finalized.
+func (b *s3Backend) Flush(name string) error {
+	name = s3Name(name)
+
+	b.mutex.Lock()
+	var names []string
+	for entryName := range b.entries {
+		if isSubPath(entryName, name) {
+			names = append(names, entryName)
+		}
+	}
+	b.mutex.Unlock()
+
+	// parents go first so that directory markers exist before their contents
+	sort.Strings(names)
+
+	for _, entryName := range names {
+		b.mutex.Lock()
+		entry, ok := b.entries[entryName]
+		b.mutex.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		entry.mutex.Lock()
+		err := b.upload(entryName, entry)
+		entry.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *s3Backend) Mkdir(name string, mode os.FileMode) error {
+	name = s3Name(name)
+
+	if _, err := b.entry(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	entry := &s3Entry{attr: defaultAttr(os.ModeDir|mode.Perm(), time.Now()), dir: true}
+	if _, err := b.client.put(b.key(name)+"/", s3Header(entry.attr), nil); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.entries[name] = entry
+	b.mutex.Unlock()
+
+	return nil
+}
+
+func (b *s3Backend) Symlink(target, name string) error {
+	name = s3Name(name)
+
+	if _, err := b.entry(name); err == nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	entry := &s3Entry{attr: defaultAttr(os.ModeSymlink|0777, time.Now()), size: int64(len(target))}
+
+	etag, err := b.client.put(b.key(name), s3Header(entry.attr), strings.NewReader(target))
+	if err != nil {
+		return err
+	}
+
+	entry.etag = etag
+
+	b.mutex.Lock()
+	b.entries[name] = entry
+	b.mutex.Unlock()
+
+	return nil
+}
+
+// objectKeys lists the keys of the objects making up an entry.
+func (b *s3Backend) objectKeys(name string, entry *s3Entry) ([]string, error) {
+	if !entry.dir {
+		return []string{b.key(name)}, nil
+	}
+
+	objects, _, err := b.client.list(b.dirPrefix(name), "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+
+	return keys, nil
+}
+
+// Objects cannot be renamed, so they are copied within the bucket before any
+// of them is removed; repeating an interrupted rename completes it.
+func (b *s3Backend) Rename(oldname, newname string) error {
+	oldname, newname = s3Name(oldname), s3Name(newname)
+
+	entry, err := b.entry(oldname)
+	if err != nil {
+		return err
+	}
+
+	if oldname == "/" || isSubPath(newname, oldname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+
+	if err := b.Flush(oldname); err != nil {
+		return err
+	}
+
+	keys, err := b.objectKeys(oldname, entry)
+	if err != nil {
+		return err
+	}
+
+	oldKey, newKey := b.key(oldname), b.key(newname)
+	for _, key := range keys {
+		if _, err := b.client.copy(key, newKey+strings.TrimPrefix(key, oldKey), nil); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		if err := b.client.remove(key); err != nil {
+			return err
+		}
+	}
+
+	b.forgetAll(oldname)
+	b.forgetAll(newname)
+	return nil
+}
+
+// Link copies a file within the bucket, which shares its contents without
+// downloading them.
+func (b *s3Backend) Link(oldname, newname string) error {
+	oldname, newname = s3Name(oldname), s3Name(newname)
+
+	entry, err := b.entry(oldname)
+	if err != nil {
+		return err
+	}
+
+	if entry.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	if _, err := b.entry(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := b.Flush(oldname); err != nil {
+		return err
+	}
+
+	if _, err := b.client.copy(b.key(oldname), b.key(newname), nil); err != nil {
+		return err
+	}
+
+	b.forgetAll(newname)
+	return nil
+}
+
+func (b *s3Backend) forget(name string, entry *s3Entry) {
+	os.Remove(b.workPath(name))
+	os.Remove(b.cachePath(name, entry.etag))
+
+	b.mutex.Lock()
+	delete(b.entries, name)
+	b.mutex.Unlock()
+}
+
+func (b *s3Backend) Remove(name string) error {
+	name = s3Name(name)
+
+	entry, err := b.entry(name)
+	if err != nil {
+		return err
+	}
+
+	if !entry.dir {
+		if err := b.client.remove(b.key(name)); err != nil {
+			return err
+		}
+
+		b.forget(name, entry)
+		return nil
+	}
+
+	infos, err := b.List(name)
+	if err != nil {
+		return err
+	}
+
+	if len(infos) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	if err := b.client.remove(b.key(name) + "/"); err != nil {
+		return err
+	}
+
+	b.forget(name, entry)
+	return nil
+}
+
+func (b *s3Backend) RemoveAll(name string) error {
+	name = s3Name(name)
+	prefix := b.dirPrefix(name)
+
+	objects, _, err := b.client.list(prefix, "", 0)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		if err := b.client.remove(object.Key); err != nil {
+			return err
+		}
+	}
+
+	if name != "/" {
+		if err := b.client.remove(b.key(name)); err != nil {
+			return err
+		}
+	}
+
+	b.forgetAll(name)
+	return nil
+}
+
+func (b *s3Backend) forgetAll(name string) {
+	b.mutex.Lock()
+	entries := make(map[string]*s3Entry)
+	for entryName, entry := range b.entries {
+		if isSubPath(entryName, name) {
+			entries[entryName] = entry
+		}
+	}
+	b.mutex.Unlock()
+
+	for entryName, entry := range entries {
+		b.forget(entryName, entry)
+	}
+}
+
+// Attribute changes to open files are uploaded together with their contents.
+func (b *s3Backend) setAttr(name string, update func(attr *fileAttr)) error {
+	name = s3Name(name)
+
+	entry, err := b.entry(name)
+	if err != nil {
+		return err
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	update(&entry.attr)
+	entry.dirty = true
+
+	if entry.open > 0 {
+		return nil
+	}
+
+	return b.upload(name, entry)
+}
+
+func (b *s3Backend) Chmod(name string, mode os.FileMode) error {
+	return b.setAttr(name, func(attr *fileAttr) {
+		attr.mode = attr.mode&os.ModeType | mode.Perm()
+	})
+}
+
+func (b *s3Backend) Chown(name string, uid, gid int) error {
+	return b.setAttr(name, func(attr *fileAttr) {
+		if uid >= 0 {
+			attr.uid = uid
+		}
+		if gid >= 0 {
+			attr.gid = gid
+		}
+	})
+}
+
+func (b *s3Backend) Chtimes(name string, atime, mtime time.Time) error {
+	return b.setAttr(name, func(attr *fileAttr) {
+		attr.atime = atime
+		attr.mtime = mtime
+	})
+}
+
+func (b *s3Backend) ReadMeta(name string) ([]byte, error) {
+	body, err := b.client.get(b.key(s3Name(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+func (b *s3Backend) WriteMeta(name string, data []byte) error {
+	_, err := b.client.put(b.key(s3Name(name)), nil, bytes.NewReader(data))
+	return err
+}
+
+//
+//	s3File
+//
+
+type s3File struct {
+	backend  *s3Backend
+	name     string
+	entry    *s3Entry
+	file     *os.File
+	writable bool
+}
+
+func (f *s3File) touch() {
+	f.entry.mutex.Lock()
+	f.entry.attr.mtime = time.Now()
+	f.entry.dirty = true
+	f.entry.mutex.Unlock()
+}
+
+func (f *s3File) Read(data []byte) (int, error) {
+	return f.file.Read(data)
+}
+
+func (f *s3File) ReadAt(data []byte, offset int64) (int, error) {
+	return f.file.ReadAt(data, offset)
+}
+
+func (f *s3File) Write(data []byte) (int, error) {
+	size, err := f.file.Write(data)
+	if size > 0 {
+		f.touch()
+	}
+
+	return size, err
+}
+
+func (f *s3File) WriteAt(data []byte, offset int64) (int, error) {
+	size, err := f.file.WriteAt(data, offset)
+	if size > 0 {
+		f.touch()
+	}
+
+	return size, err
+}
+
+func (f *s3File) Sync() error {
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	if !f.writable {
+		return nil
+	}
+
+	f.entry.mutex.Lock()
+	defer f.entry.mutex.Unlock()
+
+	return f.backend.upload(f.name, f.entry)
+}
+
+func (f *s3File) Close() error {
+	err := f.file.Close()
+	if releaseErr := f.backend.release(f.name, f.entry, f.writable); err == nil {
+		err = releaseErr
+	}
+
+	return err
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FooSoft/vfs/store/s3test"
+)
+
+// newS3Config starts an in-process S3 server with an empty bucket and
+// returns the configuration of a backend using it.
+func newS3Config(t *testing.T) S3Config {
+	server := s3test.NewServer("AKID", "SECRET")
+	t.Cleanup(server.Close)
+	server.CreateBucket("vfs")
+
+	return S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "vfs",
+		Prefix:    "/test/",
+		AccessKey: "AKID",
+		SecretKey: "SECRET",
+		Cache:     tempDir(t),
+		Exclusive: true,
+	}
+}
+
+func writeS3Config(t *testing.T, base string, config S3Config) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(base, ".vfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(base, ".vfs", "s3.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestS3Backend(t *testing.T, config S3Config) Backend {
+	b, err := NewS3Backend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestS3Upload(t *testing.T) {
+	server := s3test.NewServer("AKID", "SECRET")
+	defer server.Close()
+	server.CreateBucket("vfs")
+
+	config := S3Config{Endpoint: server.URL, Bucket: "vfs", Prefix: "test", AccessKey: "AKID", SecretKey: "SECRET", Cache: tempDir(t)}
+	b := newTestS3Backend(t, config)
+
+	if err := mkdirAll(b, "ver/root/a dir+x", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := b.OpenFile("ver/root/a dir+x/f", os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := server.Object("vfs", "test/ver/root/a dir+x/f"); ok {
+		t.Error("file uploaded before release")
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, ok := server.Object("vfs", "test/ver/root/a dir+x/f"); !ok || string(data) != "hello" {
+		t.Errorf("file not uploaded on release: %q", data)
+	}
+
+	if _, ok := server.Object("vfs", "test/ver/root/a dir+x/"); !ok {
+		t.Error("directory marker missing")
+	}
+
+	// attribute changes are uploaded on flush and keep the contents
+	if err := b.Chmod("ver/root/a dir+x/f", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.(flusher).Flush("ver"); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Cache = tempDir(t)
+	other := newTestS3Backend(t, config)
+
+	info, err := other.Stat("ver/root/a dir+x/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode() != 0600 || info.Size() != 5 {
+		t.Errorf("attributes not uploaded: %v %d", info.Mode(), info.Size())
+	}
+
+	if got := getFile(t, other, "ver/root/a dir+x/f"); got != "hello" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestS3Paging(t *testing.T) {
+	b := newTestS3Backend(t, newS3Config(t))
+	if err := mkdirAll(b, "dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 1003
+	for i := 0; i < count; i++ {
+		putFile(t, b, fmt.Sprintf("dir/f%04d", i), "")
+	}
+
+	infos, err := b.List("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != count {
+		t.Fatalf("listed %d of %d objects", len(infos), count)
+	}
+
+	if err := b.RemoveAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Stat("dir"); !os.IsNotExist(err) {
+		t.Errorf("stat after remove: %v", err)
+	}
+}
+
+func TestS3Open(t *testing.T) {
+	config := newS3Config(t)
+	config.Cache = ""
+
+	state := tempDir(t)
+	writeS3Config(t, state, config)
+
+	db, err := Open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount(t, db)
+	writeFile(t, db, "/a/f", "hello")
+	unmount(t, db)
+
+	// versions live in the bucket, and the cache in the .vfs area
+	infos, err := ioutil.ReadDir(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 || infos[0].Name() != ".vfs" {
+		t.Errorf("database directory holds versions: %v", infos)
+	}
+
+	if err := os.RemoveAll(filepath.Join(state, ".vfs", "cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Load(0); err != nil {
+		t.Fatal(err)
+	}
+
+	compareTrees(t, "reopened", map[string]string{"/": "dir", "/a": "dir", "/a/f": "file:hello"}, readTree(t, db.Root()))
+
+	bad := config
+	bad.SecretKey = "wrong"
+	writeS3Config(t, state, bad)
+	if _, err := Open(state); err == nil {
+		t.Error("opened with wrong credentials")
+	}
+
+	bad = config
+	bad.Bucket = "missing"
+	writeS3Config(t, state, bad)
+	if _, err := Open(state); err == nil {
+		t.Error("opened a missing bucket")
+	}
+}
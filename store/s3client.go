@@ -0,0 +1,416 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+//	s3Client
+//
+
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func newS3Client(config S3Config) (*s3Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", config.Endpoint)
+	}
+
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Client{endpoint, region, config.Bucket, config.AccessKey, config.SecretKey, config.Token, &http.Client{}}, nil
+}
+
+// Objects are addressed in path style, which is what MinIO and most other
+// S3-compatible servers expect.
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3EscapeQuery(query)
+	return &u
+}
+
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	var (
+		size int64
+		hash = sha256.New()
+	)
+
+	if body != nil {
+		var err error
+		if size, err = io.Copy(hash, body); err != nil {
+			return nil, err
+		}
+
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = body
+	}
+
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	c.sign(req, hex.EncodeToString(hash.Sum(nil)), time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	var s3Err s3Error
+	if data, err := ioutil.ReadAll(resp.Body); err == nil && len(data) > 0 {
+		xml.Unmarshal(data, &s3Err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound && s3Err.Code != "NoSuchBucket" {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+
+	if s3Err.Code == "" {
+		s3Err.Code = resp.Status
+	}
+
+	return nil, fmt.Errorf("s3 %s %s: %s", method, c.objectURL(key, nil).Path, s3Err.Code)
+}
+
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var headers bytes.Buffer
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.Join(req.Header.Values(name), ",")
+		}
+
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payloadHash}, "\n")
+	scope := strings.Join([]string{date, c.region, "s3", "aws4_request"}, "/")
+
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", stamp, scope, hex.EncodeToString(digest[:])}, "\n")
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSum(key, part)
+	}
+
+	signature := hex.EncodeToString(hmacSum(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signed, signature))
+}
+
+func (c *s3Client) headBucket() error {
+	resp, err := c.do(http.MethodHead, "", nil, nil, nil)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("s3 bucket not found: %s", c.bucket)
+	} else if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) head(key string) (http.Header, int64, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s3 HEAD %s: invalid content length", c.objectURL(key, nil).Path)
+	}
+
+	return resp.Header, size, nil
+}
+
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (c *s3Client) put(key string, header http.Header, body io.ReadSeeker) (string, error) {
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+
+	resp, err := c.do(http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// copy copies an object within the bucket without uploading it again; the
+// metadata is replaced by the given header, or kept when it is nil.
+func (c *s3Client) copy(src, key string, header http.Header) (string, error) {
+	if header != nil {
+		header = cloneHeader(header)
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	} else {
+		header = make(http.Header)
+	}
+
+	header.Set("X-Amz-Copy-Source", s3EscapePath("/"+c.bucket+"/"+src))
+
+	resp, err := c.do(http.MethodPut, key, nil, header, nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// copies can fail after the response has started
+	var s3Err s3Error
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return "", fmt.Errorf("s3 PUT %s: %s", c.objectURL(key, nil).Path, s3Err.Code)
+	}
+
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+
+	return result.ETag, nil
+}
+
+func (c *s3Client) remove(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// list returns the objects and common prefixes below prefix; without a
+// delimiter every object below prefix is returned.
+func (c *s3Client) list(prefix, delimiter string, limit int) ([]s3Object, []string, error) {
+	var (
+		objects  []s3Object
+		prefixes []string
+		token    string
+	)
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if limit > 0 {
+			query.Set("max-keys", strconv.Itoa(limit))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+		for _, common := range result.CommonPrefixes {
+			prefixes = append(prefixes, common.Prefix)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" || (limit > 0 && len(objects)+len(prefixes) >= limit) {
+			return objects, prefixes, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header)
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+
+	return clone
+}
+
+// Signatures are computed over paths and queries escaped the way S3 expects,
+// which differs from net/url in the handling of characters such as '+'.
+func s3Escape(value string, path bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && path:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3EscapeQuery(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
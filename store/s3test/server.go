@@ -0,0 +1,440 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package s3test provides an in-process S3-compatible server for testing the
+// S3 storage backend without access to real object storage.
+package s3test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+//	Server
+//
+
+type object struct {
+	data     []byte
+	meta     http.Header
+	etag     string
+	modified time.Time
+}
+
+// Server keeps buckets in memory and checks that requests are signed with its
+// credentials. Objects are addressed in path style.
+type Server struct {
+	URL       string
+	AccessKey string
+	SecretKey string
+	server    *httptest.Server
+	buckets   map[string]map[string]*object
+	mutex     sync.Mutex
+}
+
+func NewServer(accessKey, secretKey string) *Server {
+	s := &Server{AccessKey: accessKey, SecretKey: secretKey, buckets: make(map[string]map[string]*object)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+func (s *Server) CreateBucket(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = make(map[string]*object)
+	}
+}
+
+// Keys returns the sorted names of the objects in a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the contents of an object and whether it exists.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), obj.data...), true
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	data, err := xml.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	if code := s.authenticate(r, body); code != "" {
+		writeError(w, http.StatusForbidden, code)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if bucket == "" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		if r.Method == http.MethodPut && key == "" {
+			s.buckets[bucket] = make(map[string]*object)
+			return
+		}
+
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r.URL.Query(), objects)
+	case key == "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		obj, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		for name, values := range obj.meta {
+			w.Header()[name] = values
+		}
+
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, objects, key)
+	case r.Method == http.MethodPut:
+		obj := &object{data: body, meta: userMeta(r.Header), modified: time.Now()}
+		obj.etag = fmt.Sprintf("\"%x\"", md5.Sum(body))
+		objects[key] = obj
+
+		w.Header().Set("ETag", obj.etag)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func userMeta(header http.Header) http.Header {
+	meta := make(http.Header)
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			meta[name] = append([]string(nil), values...)
+		}
+	}
+
+	return meta
+}
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	src, ok := s.buckets[parts[0]][parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	obj := &object{data: src.data, meta: src.meta, etag: src.etag, modified: time.Now()}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		obj.meta = userMeta(r.Header)
+	}
+
+	objects[key] = obj
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{ETag: obj.etag, LastModified: obj.modified.UTC().Format(time.RFC3339)})
+}
+
+type listObject struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+type listPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *Server) list(w http.ResponseWriter, query url.Values, objects map[string]*object) {
+	if query.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	limit := 1000
+	if value := query.Get("max-keys"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName               xml.Name     `xml:"ListBucketResult"`
+		Prefix                string       `xml:"Prefix"`
+		Delimiter             string       `xml:"Delimiter,omitempty"`
+		KeyCount              int          `xml:"KeyCount"`
+		MaxKeys               int          `xml:"MaxKeys"`
+		IsTruncated           bool         `xml:"IsTruncated"`
+		ContinuationToken     string       `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string       `xml:"NextContinuationToken,omitempty"`
+		Contents              []listObject `xml:"Contents"`
+		CommonPrefixes        []listPrefix `xml:"CommonPrefixes"`
+	}{Prefix: prefix, Delimiter: delimiter, MaxKeys: limit, ContinuationToken: query.Get("continuation-token")}
+
+	// continuation tokens are the last key or prefix returned
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+
+		if delimiter != "" {
+			if index := strings.Index(key[len(prefix):], delimiter); index >= 0 {
+				common := key[:len(prefix)+index+len(delimiter)]
+				if common <= after || (len(result.CommonPrefixes) > 0 && result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix == common) {
+					continue
+				}
+
+				if result.KeyCount == limit {
+					result.IsTruncated = true
+					break
+				}
+
+				result.CommonPrefixes = append(result.CommonPrefixes, listPrefix{common})
+				result.KeyCount++
+				result.NextContinuationToken = common
+				continue
+			}
+		}
+
+		if result.KeyCount == limit {
+			result.IsTruncated = true
+			break
+		}
+
+		obj := objects[key]
+		result.Contents = append(result.Contents, listObject{key, len(obj.data), obj.etag, obj.modified.UTC().Format(time.RFC3339Nano)})
+		result.KeyCount++
+		result.NextContinuationToken = key
+	}
+
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	writeXML(w, result)
+}
+
+// authenticate checks the AWS signature version 4 of a request, returning the
+// S3 error code of a failed check.
+func (s *Server) authenticate(r *http.Request, body []byte) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return "AccessDenied"
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		if parts := strings.SplitN(strings.TrimSpace(field), "=", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != s.AccessKey {
+		return "InvalidAccessKeyId"
+	}
+
+	scope := credential[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != "s3" || scopeParts[3] != "aws4_request" {
+		return "AuthorizationHeaderMalformed"
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != "UNSIGNED-PAYLOAD" {
+		sum := sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return "XAmzContentSHA256Mismatch"
+		}
+	}
+
+	var headers bytes.Buffer
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, name := range signed {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), canonicalQuery(r.URL.Query()), headers.String(), fields["SignedHeaders"], payloadHash}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", r.Header.Get("X-Amz-Date"), scope, hex.EncodeToString(digest[:])}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range scopeParts {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(fields["Signature"])) {
+		return "SignatureDoesNotMatch"
+	}
+
+	return ""
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func escape(value string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import "testing"
+
+// Snapshots must resolve to their source just like versions written through
+// a mount, including after directories turn into files and back.
+func TestSnapshotSequence(t *testing.T) {
+	steps := []map[string]string{
+		{"a/f": "one", "a/g": "two", "b": "three", "l": "link:a/f", "d/x/y": "four"},
+		{"a/f": "one!", "b/c": "five", "d": "six", "l": "link:b/c"},
+		{"a/f": "one!", "b": "link:a", "d/z": "seven", "e": "dir"},
+		{"d": "dir", "e/h": "eight"},
+		{},
+	}
+
+	for _, hash := range []bool{false, true} {
+		hash := hash
+		t.Run(map[bool]string{false: "mtime", true: "hash"}[hash], func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, db *Database) {
+				src := tempDir(t)
+				if err := db.Lock(); err != nil {
+					t.Fatal(err)
+				}
+				defer db.Unlock()
+
+				for i, files := range steps {
+					hostFiles(t, src, i+1, files)
+					if _, err := db.Import(src, ImportOptions{Hash: hash, Live: true}); err != nil {
+						t.Fatal(err)
+					}
+
+					trees := readVersions(t, db)
+					compareTrees(t, "snapshot "+string(rune('1'+i)), hostTree(t, src), trees[len(trees)-1])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// crashBackend stops changing anything after a number of changes, as if its
+// process had died.
+type crashBackend struct {
+	Backend
+	budget int
+}
+
+var errCrash = errors.New("simulated crash")
+
+func (b *crashBackend) change() error {
+	if b.budget == 0 {
+		return errCrash
+	}
+
+	b.budget--
+	return nil
+}
+
+func (b *crashBackend) OpenFile(name string, flags int, mode os.FileMode) (BackendFile, error) {
+	if flags&(syscall.O_ACCMODE|os.O_CREATE) != os.O_RDONLY {
+		if err := b.change(); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Backend.OpenFile(name, flags, mode)
+}
+
+func (b *crashBackend) Mkdir(name string, mode os.FileMode) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Mkdir(name, mode)
+}
+
+func (b *crashBackend) Symlink(target, name string) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Symlink(target, name)
+}
+
+func (b *crashBackend) Rename(oldname, newname string) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Rename(oldname, newname)
+}
+
+func (b *crashBackend) Remove(name string) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Remove(name)
+}
+
+func (b *crashBackend) RemoveAll(name string) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.RemoveAll(name)
+}
+
+func (b *crashBackend) Chmod(name string, mode os.FileMode) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Chmod(name, mode)
+}
+
+func (b *crashBackend) Chown(name string, uid, gid int) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Chown(name, uid, gid)
+}
+
+func (b *crashBackend) Chtimes(name string, atime, mtime time.Time) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.Chtimes(name, atime, mtime)
+}
+
+func (b *crashBackend) WriteMeta(name string, data []byte) error {
+	if err := b.change(); err != nil {
+		return err
+	}
+
+	return b.Backend.WriteMeta(name, data)
+}
+
+// squashFixture creates four versions, the last of which restores a
+// directory that only the first one holds, so that squashing the first two
+// versions rewrites its references.
+func squashFixture(t *testing.T, db *Database) []map[string]string {
+	mount(t, db)
+	writeFile(t, db, "/d/g", "g")
+	writeFile(t, db, "/x", "one")
+	unmount(t, db)
+
+	mount(t, db)
+	writeFile(t, db, "/x", "two")
+	unmount(t, db)
+
+	mount(t, db)
+	removeAll(t, db, "/d")
+	unmount(t, db)
+
+	if err := db.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Restore(2, []string{"/d"}); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := db.planSquash(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.rewrites) == 0 {
+		t.Fatal("squash rewrites no references")
+	}
+
+	if err := db.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	return readVersions(t, db)
+}
+
+// checkRecovered locks the database, which finishes or rolls back an
+// interrupted squash, and checks that every remaining version still resolves
+// to its original tree.
+func checkRecovered(t *testing.T, db *Database, trees []map[string]string) {
+	t.Helper()
+
+	other := reopen(t, db)
+	if err := other.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Unlock()
+
+	if err := other.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if infos, err := other.backend.List(stagePath()); err == nil && len(infos) > 0 {
+		t.Errorf("stage area not cleaned up: %s", infos[0].Name())
+	}
+
+	actual := readVersions(t, other)
+	switch len(actual) {
+	case len(trees):
+	case len(trees) - 1:
+		trees = trees[1:]
+	default:
+		t.Fatalf("found %d versions", len(actual))
+	}
+
+	for i := range actual {
+		compareTrees(t, other.Versions()[i].Name(), trees[i], actual[i])
+	}
+}
+
+func TestSquashCrash(t *testing.T) {
+	for _, tb := range testBackends {
+		tb := tb
+		t.Run(tb.name, func(t *testing.T) {
+			for budget := 0; ; budget++ {
+				db := tb.open(t, tempDir(t))
+				trees := squashFixture(t, db)
+
+				crashed, err := OpenBackend(db.base, &crashBackend{db.backend, budget})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := crashed.Lock(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := crashed.Scan(); err != nil {
+					t.Fatal(err)
+				}
+
+				err = crashed.Prune([]bool{false, true, true, true})
+				crashed.Unlock()
+
+				if err != nil && err != errCrash && !errors.Is(err, errCrash) {
+					t.Fatalf("crash after %d changes: %v", budget, err)
+				}
+
+				checkRecovered(t, db, trees)
+				if t.Failed() {
+					t.Fatalf("crash after %d changes", budget)
+				}
+
+				if err == nil {
+					break
+				}
+			}
+		})
+	}
+}
+
+// Older releases rewrote references before swapping the squashed version in
+// and did not leave a marker behind.
+func TestSquashLegacyRollback(t *testing.T) {
+	for _, swapped := range []bool{false, true} {
+		swapped := swapped
+		forEachBackend(t, func(t *testing.T, db *Database) {
+			trees := squashFixture(t, db)
+
+			if err := db.Lock(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Scan(); err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := db.planSquash(0, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := plan.target
+			ver, err := plan.stage(stagePath(target.name()+".squash"), target.timestamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ver.meta.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ref := range plan.rewrites {
+				if err := db.rewriteRef(ref.ver.name(), ref.path, target.name()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := db.backend.Rename(target.dir, stagePath(target.name()+".prev")); err != nil {
+				t.Fatal(err)
+			}
+
+			if swapped {
+				if err := db.backend.Rename(ver.dir, target.dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := db.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+
+			checkRecovered(t, db, trees)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+//
+//	Dir
+//
+
+func (vd *Dir) Walk(fn func(node *Node) error) error {
+	if err := fn(vd.node); err != nil {
+		return err
+	}
+
+	for _, name := range vd.names() {
+		if dir, ok := vd.dirs[name]; ok {
+			if err := dir.Walk(fn); err != nil {
+				return err
+			}
+		} else if err := fn(vd.files[name].node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vd *Dir) names() []string {
+	var names []string
+	for name := range vd.dirs {
+		names = append(names, name)
+	}
+	for name := range vd.files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (vd *Dir) has(name string) bool {
+	_, isDir := vd.dirs[name]
+	_, isFile := vd.files[name]
+	return isDir || isFile
+}
+
+func (vd *Dir) Lookup(name string) *Dir {
+	if name == "/" {
+		return vd
+	}
+
+	parent := vd.Lookup(path.Dir(name))
+	if parent == nil {
+		return nil
+	}
+
+	dir, _ := parent.dirs[path.Base(name)]
+	return dir
+}
+
+func (vd *Dir) LookupNode(name string) *Node {
+	if dir := vd.Lookup(name); dir != nil {
+		return dir.node
+	}
+
+	if parent := vd.Lookup(path.Dir(name)); parent != nil {
+		if file, ok := parent.files[path.Base(name)]; ok {
+			return file.node
+		}
+	}
+
+	return nil
+}
+
+func childOnPath(dir, name string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+	return path.Join(dir, strings.SplitN(rel, "/", 2)[0])
+}
+
+func parentPaths(name string) []string {
+	var paths []string
+	for dir := path.Dir(name); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		paths = append([]string{dir}, paths...)
+	}
+
+	return paths
+}
+
+//
+//	treeSig
+//
+
+type nodeSig struct {
+	dir   bool
+	mode  os.FileMode
+	size  int64
+	mtime int64
+	uid   uint32
+	gid   uint32
+}
+
+type treeSig map[string]nodeSig
+
+func buildNodeSig(node *Node) (nodeSig, error) {
+	info, err := node.ver.db.backend.Lstat(node.rebasedPath())
+	if err != nil {
+		return nodeSig{}, err
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+
+	ns := nodeSig{info.IsDir(), info.Mode(), info.Size(), info.ModTime().UnixNano(), stat.Uid, stat.Gid}
+	if ns.dir {
+		ns.size = 0
+	}
+
+	return ns, nil
+}
+
+func buildTreeSig(root *Dir) (treeSig, error) {
+	sig := make(treeSig)
+
+	err := root.Walk(func(node *Node) error {
+		ns, err := buildNodeSig(node)
+		if err != nil {
+			return err
+		}
+
+		sig[node.path] = ns
+		return nil
+	})
+
+	return sig, err
+}
+
+func buildSubtreeSig(root *Dir, name string) (treeSig, error) {
+	if dir := root.Lookup(name); dir != nil {
+		return buildTreeSig(dir)
+	}
+
+	sig := make(treeSig)
+	if node := root.LookupNode(name); node != nil {
+		ns, err := buildNodeSig(node)
+		if err != nil {
+			return nil, err
+		}
+
+		sig[node.path] = ns
+	}
+
+	return sig, nil
+}
+
+func (s treeSig) diff(other treeSig) []string {
+	var paths []string
+	for path, ns := range s {
+		if ons, ok := other[path]; !ok || ons != ns {
+			paths = append(paths, path)
+		}
+	}
+
+	for path := range other {
+		if _, ok := s[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var inodeCnt uint64
+
+func allocInode() uint64 {
+	return atomic.AddUint64(&inodeCnt, 1)
+}
+
+func copyFile(b Backend, src, dst string) (int64, error) {
+	info, err := b.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+
+	srcFile, err := b.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := b.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+
+	return io.Copy(dstFile, srcFile)
+}
+
+func sameContent(backendA Backend, a string, backendB Backend, b string) (bool, error) {
+	fileA, err := backendA.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+
+	fileB, err := backendB.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+
+	for {
+		countA, errA := io.ReadFull(fileA, bufA)
+		countB, errB := io.ReadFull(fileB, bufB)
+
+		if countA != countB || !bytes.Equal(bufA[:countA], bufB[:countB]) {
+			return false, nil
+		}
+
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+
+		if errA != nil {
+			return false, errA
+		}
+
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	temp := path + ".tmp"
+
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
+
+func fileSum(b Backend, name string) (string, error) {
+	file, err := b.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func linkFile(b Backend, src, dst string) error {
+	if linker, ok := b.(linker); ok {
+		if err := linker.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	info, err := b.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := b.Readlink(src)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Symlink(target, dst); err != nil {
+			return err
+		}
+	} else if _, err := copyFile(b, src, dst); err != nil {
+		return err
+	}
+
+	return copyAttr(b, src, dst)
+}
+
+type fileAttr struct {
+	mode  os.FileMode
+	uid   int
+	gid   int
+	atime time.Time
+	mtime time.Time
+}
+
+func readAttr(path string) (fileAttr, error) {
+	return backendAttr(hostFS, path)
+}
+
+func backendAttr(b Backend, name string) (fileAttr, error) {
+	info, err := b.Lstat(name)
+	if err != nil {
+		return fileAttr{}, err
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+	atime := time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+
+	return fileAttr{info.Mode(), int(stat.Uid), int(stat.Gid), atime, info.ModTime()}, nil
+}
+
+// Symbolic links only keep their owner, as changing their mode or times
+// would change their targets instead.
+func (a fileAttr) apply(b Backend, name string) error {
+	if err := b.Chown(name, a.uid, a.gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+
+	if a.mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err := b.Chmod(name, a.mode); err != nil {
+		return err
+	}
+
+	return b.Chtimes(name, a.atime, a.mtime)
+}
+
+func copyAttr(b Backend, src, dst string) error {
+	attr, err := backendAttr(b, src)
+	if err != nil {
+		return err
+	}
+
+	return attr.apply(b, dst)
+}
+
+func isSubPath(path, base string) bool {
+	return path == base || strings.HasPrefix(path, base+"/")
+}
+
+func isNotDir(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+
+	return err == syscall.ENOTDIR
+}
+
+func buildVerName(timestamp time.Time) string {
+	return fmt.Sprintf("ver_%.16x_%.8x", timestamp.Unix(), timestamp.Nanosecond())
+}
+
+// Versions created before names carried nanoseconds are named ver_<seconds>.
+func isVerName(name string) bool {
+	_, err := parseVerName(name)
+	return err == nil
+}
+
+func parseVerName(name string) (time.Time, error) {
+	re, err := regexp.Compile(`^ver_([0-9a-f]+)(?:_([0-9a-f]{8}))?$`)
+	if err != nil {
+		return time.Unix(0, 0), err
+	}
+
+	matches := re.FindStringSubmatch(name)
+	if len(matches) < 3 {
+		return time.Unix(0, 0), errors.New("invalid version identifier")
+	}
+
+	seconds, err := strconv.ParseInt(matches[1], 16, 64)
+	if err != nil {
+		return time.Unix(0, 0), err
+	}
+
+	var nanoseconds int64
+	if matches[2] != "" {
+		if nanoseconds, err = strconv.ParseInt(matches[2], 16, 64); err != nil || nanoseconds >= int64(time.Second) {
+			return time.Unix(0, 0), errors.New("invalid version identifier")
+		}
+	}
+
+	return time.Unix(seconds, nanoseconds), nil
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import "testing"
+
+func TestCopyFile(t *testing.T) {
+	for _, rb := range rawBackends {
+		rb := rb
+		t.Run(rb.name, func(t *testing.T) {
+			b := rb.open(t)
+			if err := mkdirAll(b, "ver/root", 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			putFile(t, b, "ver/root/src", "contents")
+			putFile(t, b, "ver/root/dst", "stale data")
+
+			size, err := copyFile(b, "ver/root/src", "ver/root/dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size != int64(len("contents")) {
+				t.Errorf("copied %d bytes", size)
+			}
+
+			if got := getFile(t, b, "ver/root/dst"); got != "contents" {
+				t.Errorf("copy reads %q", got)
+			}
+
+			if got := getFile(t, b, "ver/root/src"); got != "contents" {
+				t.Errorf("source reads %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"errors"
+	"os"
+	"sort"
+)
+
+//
+//	VerifyResult
+//
+
+type VerifyResult struct {
+	Verified  int
+	Failed    int
+	Unchecked int
+}
+
+// Verify checks the files of the version with the given index (0 for all)
+// against their checksums and calls notify for each file that fails.
+func (db *Database) Verify(index uint, notify func(index int, path string, err error)) (VerifyResult, error) {
+	var result VerifyResult
+	if index > uint(len(db.vers)) {
+		return result, errors.New("invalid version index")
+	}
+
+	for i := range db.vers {
+		if index == 0 || int(index) == i+1 {
+			if err := db.verifyVer(i, &result, notify); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (db *Database) verifyVer(index int, result *VerifyResult, notify func(index int, path string, err error)) error {
+	ver := db.vers[index]
+
+	var paths []string
+	for path := range ver.meta.sums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := ver.verifySum(path); err != nil {
+			notify(index+1, path, err)
+			result.Failed++
+		} else {
+			result.Verified++
+		}
+	}
+
+	err := walkFiles(db.backend, ver.rebasePath(), func(path string, info os.FileInfo) error {
+		if _, ok := ver.meta.sum(path); !ok {
+			result.Unchecked++
+		}
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
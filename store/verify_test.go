@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func readHandle(t *testing.T, db *Database, name string) (string, error) {
+	_, file := db.Root().Lookup(path.Dir(name)).Child(path.Base(name))
+	if file == nil {
+		t.Fatalf("file not found: %s", name)
+	}
+
+	handle, err := file.Open(os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+
+	data, err := handle.ReadAll()
+	return string(data), err
+}
+
+func TestVerifyOpen(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		db.SetVerify(1 << 20)
+
+		// new files have no checksum until their version is finalized
+		mount(t, db)
+		writeFile(t, db, "/a", "one")
+		if data, err := readHandle(t, db, "/a"); err != nil || data != "one" {
+			t.Fatalf("expected one, got %q (%v)", data, err)
+		}
+		unmount(t, db)
+
+		mount(t, db)
+		if data, err := readHandle(t, db, "/a"); err != nil || data != "one" {
+			t.Fatalf("expected one, got %q (%v)", data, err)
+		}
+
+		writeFile(t, db, "/a", "two")
+		if data, err := readHandle(t, db, "/a"); err != nil || data != "two" {
+			t.Fatalf("expected two, got %q (%v)", data, err)
+		}
+		unmount(t, db)
+
+		putFile(t, db.backend, db.Versions()[1].rebasePath("/a"), "bad")
+
+		mount(t, db)
+		if _, err := readHandle(t, db, "/a"); err != ErrCorrupt {
+			t.Fatalf("expected %v, got %v", ErrCorrupt, err)
+		}
+		unmount(t, db)
+	})
+}
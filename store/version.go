@@ -0,0 +1,422 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+//
+//	Version
+//
+
+type Version struct {
+	dir       string
+	parent    *Version
+	timestamp time.Time
+	meta      *verMeta
+	root      *Dir
+	db        *Database
+}
+
+// newVer returns the version kept in the given backend directory, which is
+// usually named after its timestamp but may be staged elsewhere.
+func newVer(dir string, timestamp time.Time, db *Database) (*Version, error) {
+	meta, err := newVerMeta(db.backend, path.Join(dir, "meta.json"), db.AreaPath("journals", path.Base(dir)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Version{dir, nil, timestamp.Round(0), meta, nil, db}, nil
+}
+
+func (v *Version) scanDir(path string) (verNodeMap, error) {
+	var baseNodes verNodeMap
+	if v.parent != nil {
+		var err error
+
+		baseNodes, err = v.parent.scanDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		v.meta.filter(baseNodes)
+	}
+
+	ownNodes := make(verNodeMap)
+	{
+		infos, err := v.db.backend.List(v.rebasePath(path))
+		if !os.IsNotExist(err) && !isNotDir(err) {
+			if err != nil {
+				return nil, err
+			}
+
+			for _, info := range infos {
+				childFlags := 0
+				if info.IsDir() {
+					childFlags |= NodeFlagDir
+				}
+
+				childName := info.Name()
+				childPath := filepath.Join(path, childName)
+
+				ownNodes[childName] = newNode(childPath, v, nil, childFlags)
+			}
+		}
+
+		for refPath, refName := range v.meta.refs {
+			if filepath.Dir(refPath) != path {
+				continue
+			}
+
+			refVer := v.ancestor(refName)
+			if refVer == nil {
+				return nil, fmt.Errorf("missing referenced version: %s", refName)
+			}
+
+			info, err := v.db.backend.Lstat(refVer.rebasePath(refPath))
+			if err != nil {
+				return nil, err
+			}
+
+			refFlags := 0
+			if info.IsDir() {
+				refFlags |= NodeFlagDir
+			}
+
+			ownNodes[filepath.Base(refPath)] = newNode(refPath, refVer, nil, refFlags)
+		}
+
+		v.meta.filter(ownNodes)
+	}
+
+	if baseNodes == nil {
+		return ownNodes, nil
+	}
+
+	for ownName, ownNode := range ownNodes {
+		ownNode.parent, _ = baseNodes[ownName]
+		baseNodes[ownName] = ownNode
+	}
+
+	return baseNodes, nil
+}
+
+func (v *Version) buildDir(dir *Dir) error {
+	nodes, err := v.scanDir(dir.node.path)
+	if err != nil {
+		return err
+	}
+
+	for name, node := range nodes {
+		if node.flags&NodeFlagDir == NodeFlagDir {
+			subDir := newDir(node, dir)
+			if err := v.buildDir(subDir); err != nil {
+				return err
+			}
+
+			dir.dirs[name] = subDir
+		} else {
+			dir.files[name] = newFile(node, dir)
+		}
+	}
+
+	return nil
+}
+
+func (v *Version) build() (*Dir, error) {
+	node := newNode("/", v, nil, NodeFlagDir)
+	root := newDir(node, nil)
+
+	if err := v.buildDir(root); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+func (v *Version) resolve() error {
+	root, err := v.build()
+	if err != nil {
+		return err
+	}
+
+	v.root = root
+	return nil
+}
+
+func (v *Version) touches(path string) bool {
+	if _, err := v.db.backend.Lstat(v.rebasePath(path)); err == nil {
+		return true
+	}
+
+	for deletedPath := range v.meta.deleted {
+		if isSubPath(deletedPath, path) {
+			return true
+		}
+	}
+
+	for refPath := range v.meta.refs {
+		if isSubPath(refPath, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *Version) ancestor(name string) *Version {
+	for ver := v.parent; ver != nil; ver = ver.parent {
+		if ver.name() == name {
+			return ver
+		}
+	}
+
+	return nil
+}
+
+func (v *Version) name() string {
+	return path.Base(v.dir)
+}
+
+// rebasePath returns the backend name of a path within the version.
+func (v *Version) rebasePath(paths ...string) string {
+	combined := append([]string{v.dir, "root"}, paths...)
+	return path.Join(combined...)
+}
+
+func (v *Version) updateSums() error {
+	present := make(map[string]bool)
+	err := walkFiles(v.db.backend, v.rebasePath(), func(path string, info os.FileInfo) error {
+		present[path] = true
+
+		if _, ok := v.meta.sum(path); ok {
+			return nil
+		}
+
+		sum, err := fileSum(v.db.backend, v.rebasePath(path))
+		if err != nil {
+			return err
+		}
+
+		return v.meta.setSum(path, sum)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var stale []string
+	v.meta.mutex.Lock()
+	for path := range v.meta.sums {
+		if !present[path] {
+			stale = append(stale, path)
+		}
+	}
+	v.meta.mutex.Unlock()
+
+	for _, path := range stale {
+		if err := v.meta.unsetSum(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *Version) verifySum(path string) error {
+	expected, ok := v.meta.sum(path)
+	if !ok {
+		return nil
+	}
+
+	actual, err := fileSum(v.db.backend, v.rebasePath(path))
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch: %s", v.rebasePath(path))
+	}
+
+	return nil
+}
+
+func (v *Version) empty() (bool, error) {
+	if !v.meta.empty() {
+		return false, nil
+	}
+
+	infos, err := v.db.backend.List(v.rebasePath())
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil || len(infos) > 0 {
+		return false, err
+	}
+
+	if v.parent == nil {
+		return true, nil
+	}
+
+	attr, err := backendAttr(v.db.backend, v.rebasePath())
+	if err != nil {
+		return false, err
+	}
+
+	parentAttr, err := backendAttr(v.db.backend, v.parent.rebasePath())
+	if err != nil {
+		return false, err
+	}
+
+	return attr.mode == parentAttr.mode && attr.uid == parentAttr.uid && attr.gid == parentAttr.gid, nil
+}
+
+// abandoned reports whether the version is empty and was never finalized, as
+// happens when a mount dies before anything is written; empty versions that
+// were deliberately created, such as reverts, keep their metadata.
+func (v *Version) abandoned() (bool, error) {
+	empty, err := v.empty()
+	if err != nil || !empty {
+		return false, err
+	}
+
+	if _, err := v.db.backend.ReadMeta(v.meta.path); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+func (v *Version) finalize(last bool) error {
+	if backend, ok := v.db.backend.(flusher); ok {
+		if err := backend.Flush(v.dir); err != nil {
+			return err
+		}
+	}
+
+	if last {
+		empty, err := v.empty()
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			return v.discard()
+		}
+	} else if !v.meta.modified {
+		return nil
+	}
+
+	if err := v.updateSums(); err != nil {
+		return err
+	}
+
+	return v.meta.save()
+}
+
+func (v *Version) discard() error {
+	if err := v.db.backend.RemoveAll(v.dir); err != nil {
+		return err
+	}
+
+	return v.meta.discard()
+}
+
+func (v *Version) Name() string {
+	return v.name()
+}
+
+func (v *Version) Timestamp() time.Time {
+	return v.timestamp
+}
+
+func (v *Version) Tag() string {
+	return v.meta.tag
+}
+
+func (v *Version) Message() string {
+	return v.meta.message
+}
+
+func (v *Version) SetTag(tag, message string) error {
+	if err := v.meta.setTag(tag, message); err != nil {
+		return err
+	}
+
+	return v.meta.save()
+}
+
+func (v *Version) Parent() *Version {
+	return v.parent
+}
+
+// Root returns the tree resolved by Resolve, or nil if it was not resolved.
+func (v *Version) Root() *Dir {
+	return v.root
+}
+
+func (v *Version) Resolve() error {
+	return v.resolve()
+}
+
+// Open opens a file as it appears in the version for reading.
+func (v *Version) Open(name string) (BackendFile, error) {
+	root, err := v.build()
+	if err != nil {
+		return nil, err
+	}
+
+	node := root.LookupNode(name)
+	if node == nil || node.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return node.Open()
+}
+
+//
+// verList
+//
+
+type verList []*Version
+
+func (v verList) Len() int {
+	return len(v)
+}
+
+func (v verList) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+
+func (v verList) Less(i, j int) bool {
+	if !v[i].timestamp.Equal(v[j].timestamp) {
+		return v[i].timestamp.Before(v[j].timestamp)
+	}
+
+	return v[i].name() < v[j].name()
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestVerName(t *testing.T) {
+	for _, timestamp := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 999999999),
+		time.Unix(1445000000, 123456789),
+		time.Unix(1<<40, 1),
+	} {
+		name := buildVerName(timestamp)
+		parsed, err := parseVerName(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !parsed.Equal(timestamp) {
+			t.Errorf("%s: expected %v, got %v", name, timestamp, parsed)
+		}
+	}
+
+	// versions created before nanoseconds were recorded
+	if parsed, err := parseVerName("ver_5620f6a0"); err != nil {
+		t.Error(err)
+	} else if !parsed.Equal(time.Unix(0x5620f6a0, 0)) {
+		t.Errorf("legacy name: expected %v, got %v", time.Unix(0x5620f6a0, 0), parsed)
+	}
+
+	for _, name := range []string{
+		"",
+		"ver_",
+		"ver_xyz",
+		"ver_5620F6A0",
+		"ver_5620f6a0_",
+		"ver_5620f6a0_1234",
+		"ver_5620f6a0_3b9aca00",
+		"ver_5620f6a0_00000001_00000001",
+		"version_5620f6a0",
+		"5620f6a0",
+	} {
+		if _, err := parseVerName(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
+
+func TestVerOrder(t *testing.T) {
+	timestamps := []time.Time{
+		time.Unix(0xf, 0),
+		time.Unix(0xf, 1),
+		time.Unix(0xf, 999999999),
+		time.Unix(0x10, 0),
+		time.Unix(0x10, 500),
+		time.Unix(0x100, 0),
+	}
+
+	// names sort the same way as their timestamps, as listings rely on it
+	var names []string
+	for _, timestamp := range timestamps {
+		names = append(names, buildVerName(timestamp))
+	}
+
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("names out of order: %q", names)
+	}
+
+	db, err := OpenBackend(tempDir(t), NewMemoryBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// legacy names sort among the others by timestamp, and by name on a tie
+	names = append(names, "ver_f", "ver_11")
+	for _, i := range []int{7, 2, 0, 5, 6, 3, 1, 4} {
+		if err := db.backend.Mkdir(names[i], 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.backend.Mkdir(path.Join(names[i], "root"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	var scanned []string
+	for _, ver := range db.Versions() {
+		scanned = append(scanned, ver.name())
+	}
+
+	expected := []string{names[0], names[6], names[1], names[2], names[3], names[4], names[7], names[5]}
+	if !reflect.DeepEqual(scanned, expected) {
+		t.Errorf("expected %q, got %q", expected, scanned)
+	}
+
+	for i, ver := range db.Versions() {
+		if i > 0 && ver.parent != db.vers[i-1] {
+			t.Errorf("%s: parent is not the preceding version", ver.name())
+		}
+	}
+}
+
+func TestEmptyVersions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *Database) {
+		count := func() int {
+			other := reopen(t, db)
+			if err := other.Scan(); err != nil {
+				t.Fatal(err)
+			}
+
+			return len(other.Versions())
+		}
+
+		mount(t, db)
+		unmount(t, db)
+		if n := count(); n != 0 {
+			t.Fatalf("empty head kept: %d versions", n)
+		}
+
+		mount(t, db)
+		writeFile(t, db, "/f", "one")
+		unmount(t, db)
+
+		// changed attributes are changes as well
+		mount(t, db)
+		if _, err := db.Root().SetAttr(Attr{Mode: os.ModeDir | 0700}, AttrMode); err != nil {
+			t.Fatal(err)
+		}
+		unmount(t, db)
+
+		mount(t, db)
+		_, file := db.Root().Child("f")
+		if _, err := file.SetAttr(Attr{Mode: 0600}, AttrMode); err != nil {
+			t.Fatal(err)
+		}
+		unmount(t, db)
+
+		if n := count(); n != 3 {
+			t.Fatalf("expected 3 versions, got %d", n)
+		}
+
+		// mounts that die before saving leave their heads behind
+		crashed := reopen(t, db)
+		mount(t, crashed)
+		if err := crashed.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		crashed = reopen(t, db)
+		mount(t, crashed)
+		writeFile(t, crashed, "/g", "scratch")
+		removeAll(t, crashed, "/g")
+		if err := crashed.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the second mount already dropped the head of the first
+		if n := count(); n != 4 {
+			t.Fatalf("expected 4 versions before recovery, got %d", n)
+		}
+
+		writer := reopen(t, db)
+		mount(t, writer)
+		if n := len(writer.Versions()); n != 4 {
+			t.Errorf("expected 4 versions after recovery, got %d", n)
+		}
+		unmount(t, writer)
+
+		if n := count(); n != 3 {
+			t.Fatalf("expected 3 versions, got %d", n)
+		}
+
+		if infos, err := ioutil.ReadDir(db.AreaPath("journals")); err != nil || len(infos) > 0 {
+			t.Errorf("journals left behind: %d (%v)", len(infos), err)
+		}
+	})
+}
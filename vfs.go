@@ -27,21 +27,42 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/FooSoft/vfs/store"
 	// _ "bazil.org/fuse/fs/fstestutil"
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [options] database [mountpoint]\n\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "Parameters:\n")
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] database [mountpoint]\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "       %s %s %s\n", os.Args[0], cmd.name, cmd.usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nParameters:\n")
 	flag.PrintDefaults()
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd := findCommand(os.Args[1]); cmd != nil {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+	}
+
 	version := flag.Uint("version", 0, "version index (0 for head)")
 	readonly := flag.Bool("readonly", false, "mount filesystem as readonly")
+	interval := flag.Duration("interval", 0, "cut a new version at this interval (0 to disable)")
+	threshold := flag.Uint64("threshold", 0, "cut a new version after this many bytes are written (0 to disable)")
+	idle := flag.Duration("idle", 0, "cut a new version after this period of inactivity (0 to disable)")
+	timeout := flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for open files to be closed when terminated")
+	verify := flag.Int64("verify", 0, "verify checksums when opening files smaller than this many bytes (0 to disable)")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -53,18 +74,25 @@ func main() {
 	mountable := flag.NArg() > 1
 	mutable := mountable && !*readonly && *version == 0
 
-	db, err := newDatabase(flag.Arg(0))
+	db, err := store.Open(flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	db.SetVerify(*verify)
+
 	if mutable {
-		if err := db.createNewVer(); err != nil {
+		if err := db.Lock(); err != nil {
+			log.Fatal(err)
+		}
+		defer db.Unlock()
+
+		if err := db.CreateVersion(); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	if err := db.load(*version); err != nil {
+	if err := db.Load(*version); err != nil {
 		log.Fatal(err)
 	}
 
@@ -80,7 +108,34 @@ func main() {
 		}
 		defer conn.Close()
 
-		if err := fs.Serve(conn, db); err != nil {
+		server := fs.New(conn, nil)
+		db.SetInvalidate(func(dir *store.Dir, name string) {
+			server.InvalidateEntry((*fsDir)(dir), name)
+		})
+
+		stopSignals := handleSignals(db, flag.Arg(1), mutable, *timeout)
+
+		if mutable {
+			var stopControl func()
+			if stopControl, err = serveControl(db); err != nil {
+				log.Fatal(err)
+			}
+
+			stopWatch := func() {}
+			if policy := (store.Policy{Interval: *interval, Threshold: *threshold, Idle: *idle}); policy.Enabled() {
+				stopWatch = db.Watch(policy)
+			}
+
+			err = server.Serve(fsRoot{db})
+			stopWatch()
+			stopControl()
+		} else {
+			err = server.Serve(fsRoot{db})
+		}
+
+		sig := stopSignals()
+
+		if err != nil {
 			log.Fatal(err)
 		}
 
@@ -90,11 +145,22 @@ func main() {
 		}
 
 		if mutable {
-			if err := db.save(); err != nil {
+			if err := db.Save(); err != nil {
 				log.Fatal(err)
 			}
 		}
+
+		if sig != nil {
+			conn.Close()
+			if err := db.Unlock(); err != nil {
+				log.Print(err)
+			}
+
+			os.Exit(signalStatus(sig))
+		}
 	} else {
-		db.dump()
+		for index, ver := range db.Versions() {
+			fmt.Printf("version: %d\ttime: %s\n", index+1, ver.Timestamp().String())
+		}
 	}
 }